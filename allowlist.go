@@ -0,0 +1,103 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// targetAllowlist restricts the targets that may be probed to a set of host
+// names and networks.
+type targetAllowlist struct {
+	hosts map[string]bool
+	nets  []*net.IPNet
+}
+
+// parseAllowlist parses a comma-separated list of host names, IP addresses
+// and CIDR networks. An empty list returns a nil allowlist, which allows every
+// target.
+func parseAllowlist(list string) (*targetAllowlist, error) {
+	if strings.TrimSpace(list) == "" {
+		return nil, nil
+	}
+
+	a := &targetAllowlist{hosts: map[string]bool{}}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		switch {
+		case entry == "":
+			continue
+		case strings.Contains(entry, "/"):
+			_, network, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid network %q in target allowlist: %s", entry, err)
+			}
+			a.nets = append(a.nets, network)
+		case net.ParseIP(entry) != nil:
+			ip := net.ParseIP(entry)
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			a.nets = append(a.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		default:
+			a.hosts[strings.ToLower(entry)] = true
+		}
+	}
+	return a, nil
+}
+
+// allowed reports whether the target may be probed. Host names listed in the
+// allowlist are allowed as is, other targets are allowed if they resolve only
+// to addresses within the listed networks.
+func (a *targetAllowlist) allowed(ctx context.Context, target string) bool {
+	if a == nil || a.hosts[strings.ToLower(target)] {
+		return true
+	}
+	if len(a.nets) == 0 {
+		return false
+	}
+
+	addrs := []string{target}
+	if net.ParseIP(target) == nil {
+		var err error
+		addrs, err = net.DefaultResolver.LookupHost(ctx, target)
+		if err != nil || len(addrs) == 0 {
+			return false
+		}
+	}
+
+	for _, addr := range addrs {
+		if !a.contains(net.ParseIP(addr)) {
+			return false
+		}
+	}
+	return true
+}
+
+// contains reports whether the address is within one of the networks.
+func (a *targetAllowlist) contains(ip net.IP) bool {
+	if ip == nil {
+		return false
+	}
+	for _, network := range a.nets {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,78 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+)
+
+func TestParseAllowlist(t *testing.T) {
+	for _, list := range []string{"", " ", " , "} {
+		a, err := parseAllowlist(list)
+		if err != nil {
+			t.Errorf("parseAllowlist(%q): %s", list, err)
+		}
+		if list == "" && a != nil {
+			t.Errorf("parseAllowlist(%q) isn't nil", list)
+		}
+	}
+
+	for _, list := range []string{"10.0.0.0/33", "iperf.example.com, 10.0.0.1/x", "::1/129"} {
+		if _, err := parseAllowlist(list); err == nil {
+			t.Errorf("parseAllowlist(%q): expected an error", list)
+		}
+	}
+}
+
+func TestAllowlistAllowed(t *testing.T) {
+	a, err := parseAllowlist("Iperf.example.com, 192.0.2.10, 198.51.100.0/24, 2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for target, want := range map[string]bool{
+		"iperf.example.com": true,
+		"IPERF.example.com": true,
+		"192.0.2.10":        true,
+		"192.0.2.11":        false,
+		"198.51.100.200":    true,
+		"198.51.101.1":      false,
+		"2001:db8::1":       true,
+		"2001:db9::1":       false,
+		"::ffff:192.0.2.10": true,
+	} {
+		if got := a.allowed(context.Background(), target); got != want {
+			t.Errorf("allowed(%q) = %v, want %v", target, got, want)
+		}
+	}
+}
+
+func TestAllowlistHostsOnly(t *testing.T) {
+	a, err := parseAllowlist("iperf.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Without networks, unlisted targets are rejected without a lookup.
+	if a.allowed(context.Background(), "other.example.com") {
+		t.Error("allowed an unlisted host")
+	}
+}
+
+func TestNilAllowlistAllowsAll(t *testing.T) {
+	var a *targetAllowlist
+	if !a.allowed(context.Background(), "iperf.example.com") {
+		t.Error("nil allowlist rejected a target")
+	}
+}
@@ -0,0 +1,98 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+var (
+	// Metrics about the results cache.
+	cacheEntries   = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "cache_entries"), Help: "Number of probe results in the cache."})
+	cacheMisses    = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "cache_misses_total"), Help: "Probes that found no fresh result in the cache and ran iperf."})
+	cacheEvictions = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "cache_evictions_total"), Help: "Expired probe results evicted from the cache."})
+)
+
+// resultCache keeps the results of recent probes so that repeated scrapes of
+// the same probe, e.g. from several Prometheus servers, don't each saturate
+// the link with an iperf run.
+type resultCache struct {
+	mutex   sync.Mutex
+	ttl     time.Duration
+	entries map[probeConfig]cacheEntry
+}
+
+// cacheEntry is a cached probe result and the time it was stored.
+type cacheEntry struct {
+	result iperfResult
+	time   time.Time
+}
+
+// newResultCache returns a cache keeping results for ttl, a ttl of zero
+// disables caching.
+func newResultCache(ttl time.Duration) *resultCache {
+	return &resultCache{
+		ttl:     ttl,
+		entries: map[probeConfig]cacheEntry{},
+	}
+}
+
+// key returns the cache key of a probe, leaving out the settings that don't
+// change the iperf run.
+func (c *resultCache) key(config probeConfig) probeConfig {
+	config.timeout = 0
+	config.perStream = false
+	config.retries = 0
+	return config
+}
+
+// get returns the cached result of the probe if it is younger than the ttl.
+func (c *resultCache) get(config probeConfig) (iperfResult, bool) {
+	if c.ttl <= 0 {
+		return iperfResult{}, false
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	entry, ok := c.entries[c.key(config)]
+	if !ok || time.Since(entry.time) >= c.ttl {
+		cacheMisses.Inc()
+		return iperfResult{}, false
+	}
+	return entry.result, true
+}
+
+// set stores the result of the probe and evicts the expired entries.
+func (c *resultCache) set(config probeConfig, result iperfResult) {
+	if c.ttl <= 0 {
+		return
+	}
+
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	now := time.Now()
+	for k, entry := range c.entries {
+		if now.Sub(entry.time) >= c.ttl {
+			delete(c.entries, k)
+			cacheEvictions.Inc()
+		}
+	}
+	c.entries[c.key(config)] = cacheEntry{result: result, time: now}
+	cacheEntries.Set(float64(len(c.entries)))
+}
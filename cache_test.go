@@ -0,0 +1,113 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestResultCache(t *testing.T) {
+	cache := newResultCache(time.Minute)
+	config := probeConfig{target: "iperf.example.com", port: 5201, period: 5 * time.Second, parallel: 1}
+
+	if _, ok := cache.get(config); ok {
+		t.Fatal("hit on an empty cache")
+	}
+
+	var result iperfResult
+	result.End.SumSent.Bytes = 1000
+	cache.set(config, result)
+
+	got, ok := cache.get(config)
+	if !ok {
+		t.Fatal("miss on a cached probe")
+	}
+	if got.End.SumSent.Bytes != 1000 {
+		t.Errorf("got %v bytes sent, want 1000", got.End.SumSent.Bytes)
+	}
+
+	// Settings that don't change the run share the cached result.
+	same := config
+	same.timeout, same.perStream, same.retries = 30*time.Second, true, 2
+	if _, ok := cache.get(same); !ok {
+		t.Error("miss on a probe only differing in timeout, per-stream and retries")
+	}
+
+	other := config
+	other.reverse = true
+	if _, ok := cache.get(other); ok {
+		t.Error("hit on a probe running a different test")
+	}
+}
+
+func TestResultCacheExpiry(t *testing.T) {
+	cache := newResultCache(time.Minute)
+	config := probeConfig{target: "iperf.example.com", port: 5201, period: 5 * time.Second, parallel: 1}
+	cache.set(config, iperfResult{})
+
+	entry := cache.entries[cache.key(config)]
+	entry.time = time.Now().Add(-time.Minute)
+	cache.entries[cache.key(config)] = entry
+
+	if _, ok := cache.get(config); ok {
+		t.Error("hit on an expired result")
+	}
+}
+
+func TestResultCacheDisabled(t *testing.T) {
+	cache := newResultCache(0)
+	config := probeConfig{target: "iperf.example.com", port: 5201, period: 5 * time.Second, parallel: 1}
+	cache.set(config, iperfResult{})
+
+	if _, ok := cache.get(config); ok {
+		t.Error("hit with caching disabled")
+	}
+	if len(cache.entries) != 0 {
+		t.Errorf("stored %d results with caching disabled", len(cache.entries))
+	}
+}
+
+func TestResultCacheMetrics(t *testing.T) {
+	cache := newResultCache(time.Minute)
+	stale := probeConfig{target: "stale.example.com", port: 5201, period: 5 * time.Second, parallel: 1}
+	fresh := probeConfig{target: "fresh.example.com", port: 5201, period: 5 * time.Second, parallel: 1}
+
+	misses := testutil.ToFloat64(cacheMisses)
+	evictions := testutil.ToFloat64(cacheEvictions)
+
+	cache.get(stale)
+	cache.set(stale, iperfResult{})
+	cache.get(stale)
+	if got := testutil.ToFloat64(cacheMisses) - misses; got != 1 {
+		t.Errorf("counted %v misses, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheEntries); got != 1 {
+		t.Errorf("got %v cache entries, want 1", got)
+	}
+
+	entry := cache.entries[cache.key(stale)]
+	entry.time = time.Now().Add(-time.Minute)
+	cache.entries[cache.key(stale)] = entry
+
+	cache.set(fresh, iperfResult{})
+	if got := testutil.ToFloat64(cacheEvictions) - evictions; got != 1 {
+		t.Errorf("counted %v evictions, want 1", got)
+	}
+	if got := testutil.ToFloat64(cacheEntries); got != 1 {
+		t.Errorf("got %v cache entries after the eviction, want 1", got)
+	}
+}
@@ -0,0 +1,337 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+	"gopkg.in/yaml.v3"
+)
+
+// fileConfig is the format of the --config.file YAML configuration file. Its
+// settings replace the defaults of the matching command-line flags, flags
+// given on the command line take precedence.
+type fileConfig struct {
+	ListenAddress   string                   `yaml:"listen_address"`
+	Timeout         time.Duration            `yaml:"timeout"`
+	TargetAllowlist []string                 `yaml:"target_allowlist"`
+	Defaults        probeDefaults            `yaml:"defaults"`
+	Targets         map[string]probeDefaults `yaml:"targets"`
+}
+
+// probeDefaults are the parameters used when a probe doesn't specify them,
+// unset fields fall back to the global defaults.
+type probeDefaults struct {
+	Period         time.Duration  `yaml:"period"`
+	Bitrate        string         `yaml:"bitrate"`
+	ConnectTimeout *time.Duration `yaml:"connect_timeout"`
+	Retries        *int           `yaml:"retries"`
+}
+
+// targetDefaults are the probe defaults of the targets matching a glob pattern.
+type targetDefaults struct {
+	pattern string
+	probeDefaults
+}
+
+var (
+	// Per-target probe defaults, most specific pattern first.
+	targetOverrides []targetDefaults
+
+	// Guards the settings replaced when the configuration file is reloaded.
+	configMutex sync.RWMutex
+
+	// Settings given by the flags, which the configuration file is applied to.
+	flagSettings settings
+)
+
+// settings are the settings replaced when the configuration file is reloaded.
+type settings struct {
+	allowlist      string
+	period         time.Duration
+	bitrate        string
+	connectTimeout time.Duration
+	retries        int
+	targets        []targetDefaults
+}
+
+// currentSettings returns the settings in effect.
+func currentSettings() settings {
+	return settings{
+		allowlist:      *targetAllowlistFlag,
+		period:         *defaultPeriod,
+		bitrate:        *defaultBitrate,
+		connectTimeout: *connectTimeout,
+		retries:        *retries,
+		targets:        targetOverrides,
+	}
+}
+
+// restore puts the settings back into effect.
+func (s settings) restore() {
+	*targetAllowlistFlag = s.allowlist
+	*defaultPeriod = s.period
+	*defaultBitrate = s.bitrate
+	*connectTimeout = s.connectTimeout
+	*retries = s.retries
+	targetOverrides = s.targets
+}
+
+// reloadConfig reads the configuration file again and replaces the target
+// allowlist and the probe defaults, or keeps the previous ones if it is
+// invalid. The listen address and timeout only change on restart.
+func reloadConfig() error {
+	configMutex.Lock()
+	defer configMutex.Unlock()
+
+	previous := currentSettings()
+	flagSettings.restore()
+	err := loadConfig(*configFile, os.Args[1:], true)
+	if err == nil {
+		err = validateConfig()
+	}
+	var list *targetAllowlist
+	if err == nil {
+		list, err = parseAllowlist(*targetAllowlistFlag)
+	}
+	if err != nil {
+		previous.restore()
+		return err
+	}
+
+	allowlist = list
+	defaultPeriodGauge.Set(defaultPeriod.Seconds())
+	return nil
+}
+
+// loadConfig reads the configuration file and applies its settings to
+// the flags given neither in args nor in the environment.
+func loadConfig(file string, args []string, reload bool) error {
+	f, err := os.Open(file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var c fileConfig
+	dec := yaml.NewDecoder(f)
+	dec.KnownFields(true)
+	if err := dec.Decode(&c); err != nil {
+		return fmt.Errorf("failed to parse %s: %s", file, err)
+	}
+
+	set, err := cmdlineFlags(args)
+	if err != nil {
+		return err
+	}
+	// The listen address and timeout are only read at startup.
+	if c.ListenAddress != "" && !set["web.listen-address"] && !reload {
+		*listenAddress = c.ListenAddress
+	}
+	if c.Timeout != 0 && !set["iperf3.timeout"] && !reload {
+		*timeout = c.Timeout
+	}
+	if c.TargetAllowlist != nil && !set["iperf3.target-allowlist"] {
+		*targetAllowlistFlag = strings.Join(c.TargetAllowlist, ",")
+	}
+	if c.Defaults.Period != 0 && !set["iperf3.default-period"] {
+		*defaultPeriod = c.Defaults.Period
+	}
+	if c.Defaults.Bitrate != "" && !set["iperf3.default-bitrate"] {
+		*defaultBitrate = c.Defaults.Bitrate
+	}
+	if c.Defaults.ConnectTimeout != nil && !set["iperf3.connect-timeout"] {
+		*connectTimeout = *c.Defaults.ConnectTimeout
+	}
+	if c.Defaults.Retries != nil && !set["iperf3.retries"] {
+		*retries = *c.Defaults.Retries
+	}
+
+	targetOverrides = nil
+	for pattern, d := range c.Targets {
+		targetOverrides = append(targetOverrides, targetDefaults{pattern: strings.ToLower(pattern), probeDefaults: d})
+	}
+	sort.Slice(targetOverrides, func(i, j int) bool {
+		a, b := targetOverrides[i].pattern, targetOverrides[j].pattern
+		if specificity(a) != specificity(b) {
+			return specificity(a) > specificity(b)
+		}
+		return a < b
+	})
+	return nil
+}
+
+// specificity ranks glob patterns by their number of literal characters.
+func specificity(pattern string) int {
+	return len(pattern) - strings.Count(pattern, "*") - strings.Count(pattern, "?")
+}
+
+// defaultsFor returns the probe defaults of target, taken from the most
+// specific pattern matching it and otherwise from the global defaults.
+func defaultsFor(target string) probeDefaults {
+	runConnectTimeout, runRetries := *connectTimeout, *retries
+	d := probeDefaults{
+		Period:         *defaultPeriod,
+		Bitrate:        *defaultBitrate,
+		ConnectTimeout: &runConnectTimeout,
+		Retries:        &runRetries,
+	}
+	target = strings.ToLower(target)
+	for _, o := range targetOverrides {
+		if ok, _ := path.Match(o.pattern, target); !ok {
+			continue
+		}
+		if o.Period != 0 {
+			d.Period = o.Period
+		}
+		if o.Bitrate != "" {
+			d.Bitrate = o.Bitrate
+		}
+		if o.ConnectTimeout != nil {
+			d.ConnectTimeout = o.ConnectTimeout
+		}
+		if o.Retries != nil {
+			d.Retries = o.Retries
+		}
+		break
+	}
+	return d
+}
+
+// cmdlineFlags returns the names of the flags given in args or set from their
+// environment variable.
+func cmdlineFlags(args []string) (map[string]bool, error) {
+	ctx, err := kingpin.CommandLine.ParseContext(args)
+	if err != nil {
+		return nil, err
+	}
+	set := map[string]bool{}
+	for _, el := range ctx.Elements {
+		if f, ok := el.Clause.(*kingpin.FlagClause); ok {
+			set[f.Model().Name] = true
+		}
+	}
+	for _, f := range kingpin.CommandLine.Model().Flags {
+		if _, ok := os.LookupEnv(f.Envar); ok && f.Envar != "" {
+			set[f.Name] = true
+		}
+	}
+	return set, nil
+}
+
+// setEnvars lets every flag of app be set from an environment variable named
+// after it, e.g. IPERF3_TIMEOUT for --iperf3.timeout. Flags given on the
+// command line take precedence.
+func setEnvars(app *kingpin.Application) {
+	for _, f := range app.Model().Flags {
+		if f.Hidden || f.Name == "help" || f.Name == "version" {
+			continue
+		}
+		app.GetFlag(f.Name).Envar(envarName(f.Name))
+	}
+}
+
+// envarName returns the name of the environment variable setting flag.
+func envarName(flag string) string {
+	return strings.ToUpper(strings.NewReplacer(".", "_", "-", "_").Replace(flag))
+}
+
+// checkConfig loads the configuration file, if any, and checks it along with
+// the flags, as done at startup.
+func checkConfig() error {
+	if *configFile != "" {
+		if err := loadConfig(*configFile, os.Args[1:], false); err != nil {
+			return err
+		}
+	}
+	if err := validateConfig(); err != nil {
+		return err
+	}
+	_, err := parseAllowlist(*targetAllowlistFlag)
+	return err
+}
+
+// validateConfig checks the settings that are not validated by the flag
+// parser itself.
+func validateConfig() error {
+	if *timeout < minTimeout {
+		return fmt.Errorf("invalid iperf3 timeout %s, it must be at least %s", *timeout, minTimeout)
+	}
+	if *maxTimeout != 0 && *maxTimeout < minTimeout {
+		return fmt.Errorf("invalid maximum iperf3 timeout %s, it must be at least %s", *maxTimeout, minTimeout)
+	}
+	if *maxTimeout != 0 && *maxTimeout < *timeout {
+		return fmt.Errorf("invalid maximum iperf3 timeout %s, it must not be below the iperf3 timeout %s", *maxTimeout, *timeout)
+	}
+	if *defaultPeriod <= 0 {
+		return fmt.Errorf("invalid default period %s, it must be positive", *defaultPeriod)
+	}
+	if *defaultBitrate != "" && !bitrateRegexp.MatchString(*defaultBitrate) {
+		return fmt.Errorf("invalid default bitrate %q, it must be a rate such as 100M or 1G", *defaultBitrate)
+	}
+	if *connectTimeout < 0 {
+		return fmt.Errorf("invalid connect timeout %s, it must not be negative", *connectTimeout)
+	}
+	if *retries < 0 {
+		return fmt.Errorf("invalid retries %d, it must not be negative", *retries)
+	}
+	if *perTargetLimit < 1 {
+		return fmt.Errorf("invalid per-target probe concurrency %d, it must be at least 1", *perTargetLimit)
+	}
+	if *perTargetQueue < 0 {
+		return fmt.Errorf("invalid per-target probe queue %d, it must not be negative", *perTargetQueue)
+	}
+	for _, arg := range *extraArgs {
+		if !extraArgRegexp.MatchString(arg) {
+			return fmt.Errorf("invalid extra iperf argument %q, it may only contain letters, digits and _ . , : = / + -", arg)
+		}
+	}
+	if *authUsername != "" {
+		if *authPublicKey == "" {
+			return errors.New("an RSA public key path is required to authenticate with a username")
+		}
+		if _, err := os.Stat(*authPublicKey); err != nil {
+			return fmt.Errorf("invalid RSA public key path: %s", err)
+		}
+		if _, ok := os.LookupEnv("IPERF3_PASSWORD"); !ok {
+			return errors.New("the IPERF3_PASSWORD environment variable must be set to authenticate with a username")
+		}
+	}
+	for _, o := range targetOverrides {
+		if _, err := path.Match(o.pattern, ""); err != nil {
+			return fmt.Errorf("invalid target pattern %q: %s", o.pattern, err)
+		}
+		if o.Period < 0 {
+			return fmt.Errorf("invalid period %s for targets %q, it must be positive", o.Period, o.pattern)
+		}
+		if o.Bitrate != "" && !bitrateRegexp.MatchString(o.Bitrate) {
+			return fmt.Errorf("invalid bitrate %q for targets %q, it must be a rate such as 100M or 1G", o.Bitrate, o.pattern)
+		}
+		if o.ConnectTimeout != nil && *o.ConnectTimeout < 0 {
+			return fmt.Errorf("invalid connect timeout %s for targets %q, it must not be negative", *o.ConnectTimeout, o.pattern)
+		}
+		if o.Retries != nil && *o.Retries < 0 {
+			return fmt.Errorf("invalid retries %d for targets %q, it must not be negative", *o.Retries, o.pattern)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+// writeConfig writes a configuration file and returns its path.
+func writeConfig(t *testing.T, config string) string {
+	f, err := ioutil.TempFile("", "iperf3_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.WriteString(config); err != nil {
+		t.Fatal(err)
+	}
+	return f.Name()
+}
+
+func TestDefaultsFor(t *testing.T) {
+	defer currentSettings().restore()
+
+	file := writeConfig(t, `
+defaults:
+  period: 10s
+  bitrate: 100M
+targets:
+  "*.example.com":
+    period: 20s
+    retries: 1
+  "iperf?.example.com":
+    bitrate: 1G
+  "iperf1.example.com":
+    connect_timeout: 2s
+`)
+	defer os.Remove(file)
+	if err := loadConfig(file, nil, false); err != nil {
+		t.Fatal(err)
+	}
+	*connectTimeout, *retries = 3*time.Second, 0
+
+	tests := []struct {
+		target         string
+		period         time.Duration
+		bitrate        string
+		connectTimeout time.Duration
+		retries        int
+	}{
+		// Only the most specific pattern applies, unset fields fall back
+		// to the global defaults.
+		{"iperf1.example.com", 10 * time.Second, "100M", 2 * time.Second, 0},
+		{"IPERF2.example.com", 10 * time.Second, "1G", 3 * time.Second, 0},
+		{"speed.example.com", 20 * time.Second, "100M", 3 * time.Second, 1},
+		{"iperf.example.org", 10 * time.Second, "100M", 3 * time.Second, 0},
+	}
+	for _, test := range tests {
+		d := defaultsFor(test.target)
+		if d.Period != test.period || d.Bitrate != test.bitrate || *d.ConnectTimeout != test.connectTimeout || *d.Retries != test.retries {
+			t.Errorf("defaultsFor(%q) = %s %q %s %d, want %s %q %s %d", test.target,
+				d.Period, d.Bitrate, *d.ConnectTimeout, *d.Retries,
+				test.period, test.bitrate, test.connectTimeout, test.retries)
+		}
+	}
+}
+
+func TestValidateMaxTimeout(t *testing.T) {
+	defer func(saved time.Duration) { *maxTimeout = saved }(*maxTimeout)
+
+	for max, valid := range map[time.Duration]bool{
+		0:                        true,
+		*timeout:                 true,
+		2 * *timeout:             true,
+		*timeout - time.Second:   false,
+		minTimeout - time.Second: false,
+	} {
+		*maxTimeout = max
+		if err := validateConfig(); (err == nil) != valid {
+			t.Errorf("max timeout %s with timeout %s: got error %v, want valid %v", max, *timeout, err, valid)
+		}
+	}
+}
+
+func TestValidateExtraArgs(t *testing.T) {
+	defer func(saved []string) { *extraArgs = saved }(*extraArgs)
+
+	tests := []struct {
+		args  []string
+		valid bool
+	}{
+		{nil, true},
+		{[]string{"--dont-fragment"}, true},
+		{[]string{"--logfile=/var/log/iperf3.log", "-A", "2,3"}, true},
+		{[]string{"--extra-data", "host:rack+1"}, true},
+		{[]string{"--dont-fragment", "; rm -rf /"}, false},
+		{[]string{"$(reboot)"}, false},
+		{[]string{"-T", "a b"}, false},
+		{[]string{"`id`"}, false},
+		{[]string{"--title='x'"}, false},
+		{[]string{""}, false},
+	}
+	for _, test := range tests {
+		*extraArgs = test.args
+		if err := validateConfig(); (err == nil) != test.valid {
+			t.Errorf("extra args %q: got error %v, want valid %v", test.args, err, test.valid)
+		}
+	}
+}
+
+func TestValidateAuth(t *testing.T) {
+	defer func(username, key string) { *authUsername, *authPublicKey = username, key }(*authUsername, *authPublicKey)
+	defer func(password string, ok bool) {
+		if ok {
+			os.Setenv("IPERF3_PASSWORD", password)
+		} else {
+			os.Unsetenv("IPERF3_PASSWORD")
+		}
+	}(os.LookupEnv("IPERF3_PASSWORD"))
+	key := writeConfig(t, "-----BEGIN PUBLIC KEY-----\n")
+	defer os.Remove(key)
+
+	tests := []struct {
+		username string
+		key      string
+		password bool
+		valid    bool
+	}{
+		{"", "", false, true},
+		{"probe", "", true, false},
+		{"probe", key + ".missing", true, false},
+		{"probe", key, false, false},
+		{"probe", key, true, true},
+	}
+	for _, test := range tests {
+		*authUsername, *authPublicKey = test.username, test.key
+		if test.password {
+			os.Setenv("IPERF3_PASSWORD", "secret")
+		} else {
+			os.Unsetenv("IPERF3_PASSWORD")
+		}
+		if err := validateConfig(); (err == nil) != test.valid {
+			t.Errorf("username %q, key %q, password %v: got error %v, want valid %v", test.username, test.key, test.password, err, test.valid)
+		}
+	}
+}
+
+// withConfigFile makes file the configuration file reloaded with no flags
+// given on the command line, and returns a function restoring the settings.
+func withConfigFile(file string) func() {
+	savedFile, savedArgs, savedFlags, savedAllowlist := *configFile, os.Args, flagSettings, allowlist
+	saved := currentSettings()
+	*configFile, os.Args, flagSettings = file, []string{"iperf3_exporter"}, saved
+	return func() {
+		*configFile, os.Args, flagSettings, allowlist = savedFile, savedArgs, savedFlags, savedAllowlist
+		saved.restore()
+	}
+}
+
+func TestReloadConfigAllowlist(t *testing.T) {
+	defer fakeIperf3(t, 0)()
+	file := writeConfig(t, "target_allowlist: [127.0.0.1]\n")
+	defer os.Remove(file)
+	defer withConfigFile(file)()
+
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if code := probeRequest("target=127.0.0.2").Code; code != http.StatusForbidden {
+		t.Errorf("probe of a target missing from the allowlist got status %d, want %d", code, http.StatusForbidden)
+	}
+
+	if err := ioutil.WriteFile(file, []byte("target_allowlist: [127.0.0.2]\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	if code := probeRequest("target=127.0.0.2").Code; code != http.StatusOK {
+		t.Errorf("probe of a target added to the allowlist got status %d, want %d", code, http.StatusOK)
+	}
+	if code := probeRequest("target=127.0.0.1").Code; code != http.StatusForbidden {
+		t.Errorf("probe of a target removed from the allowlist got status %d, want %d", code, http.StatusForbidden)
+	}
+}
+
+func TestReloadInvalidConfigKeepsSettings(t *testing.T) {
+	file := writeConfig(t, "target_allowlist: [127.0.0.1]\ndefaults:\n  period: 7s\n")
+	defer os.Remove(file)
+	defer withConfigFile(file)()
+
+	if err := reloadConfig(); err != nil {
+		t.Fatal(err)
+	}
+	for _, config := range []string{
+		"defaults:\n  period: [\n",
+		"defaults:\n  bitrate: fast\n",
+		"target_allowlist: [10.0.0.0/33]\n",
+	} {
+		if err := ioutil.WriteFile(file, []byte(config), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := reloadConfig(); err == nil {
+			t.Errorf("reloading %q: expected an error", config)
+		}
+		if *defaultPeriod != 7*time.Second || *defaultBitrate != "" {
+			t.Errorf("reloading %q: got period %s and bitrate %q, want the previous ones", config, *defaultPeriod, *defaultBitrate)
+		}
+		if !allowlist.allowed(context.Background(), "127.0.0.1") || allowlist.allowed(context.Background(), "127.0.0.2") {
+			t.Errorf("reloading %q replaced the allowlist", config)
+		}
+	}
+}
+
+func TestCheckConfig(t *testing.T) {
+	for name, test := range map[string]struct {
+		config string
+		valid  bool
+	}{
+		"valid":               {"target_allowlist: [iperf.example.com]\ndefaults:\n  bitrate: 100M\ntargets:\n  \"*.example.com\":\n    period: 10s\n", true},
+		"unknown field":       {"defaults:\n  bandwidth: 100M\n", false},
+		"bad bitrate":         {"defaults:\n  bitrate: fast\n", false},
+		"bad target pattern":  {"targets:\n  \"[iperf\":\n    period: 10s\n", false},
+		"bad target bitrate":  {"targets:\n  \"*.example.com\":\n    bitrate: fast\n", false},
+		"bad allowlist entry": {"target_allowlist: [10.0.0.0/33]\n", false},
+	} {
+		t.Run(name, func(t *testing.T) {
+			file := writeConfig(t, test.config)
+			defer os.Remove(file)
+			defer withConfigFile(file)()
+
+			if err := checkConfig(); (err == nil) != test.valid {
+				t.Errorf("got error %v, want valid %v", err, test.valid)
+			}
+		})
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	defer currentSettings().restore()
+	defer func(address string, d time.Duration) { *listenAddress, *timeout = address, d }(*listenAddress, *timeout)
+	defer os.Unsetenv("IPERF3_DEFAULT_BITRATE")
+	setEnvars(kingpin.CommandLine)
+
+	file := writeConfig(t, `
+listen_address: ":9999"
+timeout: 20s
+target_allowlist: ["*.example.com", "10.0.0.0/8"]
+defaults:
+  period: 10s
+  bitrate: 100M
+  retries: 2
+`)
+	defer os.Remove(file)
+
+	// The flag given on the command line and the one set from its
+	// environment variable keep their values.
+	*listenAddress, *timeout, *defaultPeriod, *defaultBitrate, *retries = ":9579", 30*time.Second, 5*time.Second, "1G", 0
+	os.Setenv("IPERF3_DEFAULT_BITRATE", "1G")
+	if err := loadConfig(file, []string{"--iperf3.default-period=5s"}, false); err != nil {
+		t.Fatal(err)
+	}
+	if *listenAddress != ":9999" || *timeout != 20*time.Second || *targetAllowlistFlag != "*.example.com,10.0.0.0/8" || *retries != 2 {
+		t.Errorf("got %q %s %q %d from the file, want \":9999\" 20s \"*.example.com,10.0.0.0/8\" 2",
+			*listenAddress, *timeout, *targetAllowlistFlag, *retries)
+	}
+	if *defaultPeriod != 5*time.Second {
+		t.Errorf("got period %s, want the command-line 5s", *defaultPeriod)
+	}
+	if *defaultBitrate != "1G" {
+		t.Errorf("got bitrate %q, want the environment 1G", *defaultBitrate)
+	}
+
+	// A reload leaves the listen address and timeout alone.
+	*listenAddress, *timeout = ":9579", 30*time.Second
+	if err := loadConfig(file, nil, true); err != nil {
+		t.Fatal(err)
+	}
+	if *listenAddress != ":9579" || *timeout != 30*time.Second {
+		t.Errorf("reload got %q %s, want \":9579\" 30s", *listenAddress, *timeout)
+	}
+
+	unknown := writeConfig(t, "defaults:\n  perod: 10s\n")
+	defer os.Remove(unknown)
+	if err := loadConfig(unknown, nil, false); err == nil || !strings.Contains(err.Error(), "perod") {
+		t.Errorf("got %v, want an unknown field error", err)
+	}
+	if err := loadConfig(file+".missing", nil, false); err == nil {
+		t.Error("missing file got no error")
+	}
+}
+
+func TestEnvarName(t *testing.T) {
+	tests := map[string]string{
+		"iperf3.timeout":         "IPERF3_TIMEOUT",
+		"web.listen-address":     "WEB_LISTEN_ADDRESS",
+		"iperf3.max-concurrent":  "IPERF3_MAX_CONCURRENT",
+		"log.error-interval":     "LOG_ERROR_INTERVAL",
+		"iperf3.default-bitrate": "IPERF3_DEFAULT_BITRATE",
+	}
+	for flag, want := range tests {
+		if got := envarName(flag); got != want {
+			t.Errorf("envarName(%q) = %q, want %q", flag, got, want)
+		}
+	}
+}
+
+func TestSetEnvars(t *testing.T) {
+	app := kingpin.New("iperf3_exporter", "")
+	app.HelpFlag.Short('h')
+	app.Version("1.0")
+	period := app.Flag("iperf3.default-period", "").Default("5s").Duration()
+	address := app.Flag("web.listen-address", "").Default(":9579").String()
+	app.Flag("hidden", "").Hidden().String()
+	setEnvars(app)
+
+	for _, f := range app.Model().Flags {
+		want := envarName(f.Name)
+		if f.Hidden || f.Name == "help" || f.Name == "version" {
+			want = ""
+		}
+		if f.Envar != want {
+			t.Errorf("flag %s got environment variable %q, want %q", f.Name, f.Envar, want)
+		}
+	}
+
+	defer os.Unsetenv("IPERF3_DEFAULT_PERIOD")
+	defer os.Unsetenv("WEB_LISTEN_ADDRESS")
+	os.Setenv("IPERF3_DEFAULT_PERIOD", "20s")
+	os.Setenv("WEB_LISTEN_ADDRESS", ":9999")
+	if _, err := app.Parse([]string{"--web.listen-address=:9100"}); err != nil {
+		t.Fatal(err)
+	}
+	if *period != 20*time.Second {
+		t.Errorf("got period %s, want the environment 20s", *period)
+	}
+	if *address != ":9100" {
+		t.Errorf("got listen address %q, want the command-line :9100", *address)
+	}
+}
@@ -3,7 +3,9 @@ module github.com/edgard/iperf3_exporter
 go 1.12
 
 require (
-	github.com/prometheus/client_golang v0.9.2
-	github.com/prometheus/common v0.3.0
+	github.com/prometheus/client_golang v1.11.1
+	github.com/prometheus/common v0.26.0
+	golang.org/x/time v0.0.0-20190921001708-c4c64cad1fd0
 	gopkg.in/alecthomas/kingpin.v2 v2.2.6
+	gopkg.in/yaml.v3 v3.0.1
 )
@@ -0,0 +1,73 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os/exec"
+	"strconv"
+	"time"
+)
+
+// deepHealthTimeout bounds the iperf client run of deep health checks.
+const deepHealthTimeout = 5 * time.Second
+
+// selfTestConfig is the short probe of a local server run by --iperf3.selftest.
+var selfTestConfig = probeConfig{
+	target:   "127.0.0.1",
+	port:     5201,
+	period:   time.Second,
+	timeout:  10 * time.Second,
+	parallel: 1,
+}
+
+// healthHandler reports whether the iperf client binary can be found, and with
+// deep=true whether it runs.
+func healthHandler(w http.ResponseWriter, r *http.Request) {
+	if _, err := exec.LookPath(client.Command()); err != nil {
+		http.Error(w, fmt.Sprintf("Unhealthy: %s", err), http.StatusServiceUnavailable)
+		return
+	}
+
+	if deep, _ := strconv.ParseBool(r.URL.Query().Get("deep")); deep {
+		ctx, cancel := context.WithTimeout(r.Context(), deepHealthTimeout)
+		defer cancel()
+		if _, err := iperfVersion(ctx); err != nil {
+			http.Error(w, fmt.Sprintf("Unhealthy: %s", err), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "Healthy")
+}
+
+// readyHandler reports whether the exporter can accept another probe, that
+// is whether a probe slot is free when --iperf3.max-concurrent is set.
+func readyHandler(w http.ResponseWriter, r *http.Request) {
+	if probeSlots != nil && len(probeSlots) == cap(probeSlots) {
+		http.Error(w, fmt.Sprintf("Not ready: %d probes in flight", len(probeSlots)), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(w, "Ready")
+}
+
+// runSelfTest probes the local iperf3 server, reporting whether the exporter
+// is able to run probes.
+func runSelfTest() error {
+	config := selfTestConfig
+	config.connectTimeout = *connectTimeout
+	_, _, err := NewExporter(context.Background(), config, nil).probe()
+	return err
+}
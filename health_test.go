@@ -0,0 +1,122 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"strings"
+	"testing"
+)
+
+func TestReadyHandler(t *testing.T) {
+	defer func() { probeSlots = nil }()
+
+	ready := func() int {
+		rec := httptest.NewRecorder()
+		readyHandler(rec, httptest.NewRequest("GET", "/ready", nil))
+		return rec.Code
+	}
+
+	// Without --iperf3.max-concurrent the exporter is always ready.
+	probeSlots = nil
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("got status %d without a concurrency limit, want %d", code, http.StatusOK)
+	}
+
+	probeSlots = make(chan struct{}, 2)
+	probeSlots <- struct{}{}
+	if code := ready(); code != http.StatusOK {
+		t.Errorf("got status %d with a free probe slot, want %d", code, http.StatusOK)
+	}
+	probeSlots <- struct{}{}
+	if code := ready(); code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d with all probe slots taken, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+// health returns the status of a health check with the query.
+func health(query string) int {
+	rec := httptest.NewRecorder()
+	healthHandler(rec, httptest.NewRequest("GET", "/health?"+query, nil))
+	return rec.Code
+}
+
+func TestHealthHandler(t *testing.T) {
+	defer fakeIperf3Script(t, "echo 'iperf 3.9 (cJSON 1.7.13)'\n")()
+
+	for _, query := range []string{"", "deep=true"} {
+		if code := health(query); code != http.StatusOK {
+			t.Errorf("%q: got status %d, want %d", query, code, http.StatusOK)
+		}
+	}
+}
+
+func TestHealthHandlerFailingBinary(t *testing.T) {
+	defer fakeIperf3Script(t, "echo 'iperf3: error while loading shared libraries: libiperf.so.0' >&2\nexit 127\n")()
+
+	// Only the deep check runs the binary.
+	if code := health(""); code != http.StatusOK {
+		t.Errorf("got status %d, want %d", code, http.StatusOK)
+	}
+	if code := health("deep=true"); code != http.StatusServiceUnavailable {
+		t.Errorf("deep check got status %d, want %d", code, http.StatusServiceUnavailable)
+	}
+}
+
+func TestHealthHandlerMissingBinary(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iperf3_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { os.Setenv("PATH", path) }(os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+
+	for _, query := range []string{"", "deep=true"} {
+		if code := health(query); code != http.StatusServiceUnavailable {
+			t.Errorf("%q: got status %d, want %d", query, code, http.StatusServiceUnavailable)
+		}
+	}
+}
+
+func TestRunSelfTest(t *testing.T) {
+	defer fakeIperf3Script(t, "echo \"$@\" > \"$0.args\"\necho '"+fakeResult+"'\n")()
+	if err := runSelfTest(); err != nil {
+		t.Fatalf("self-test failed: %s", err)
+	}
+
+	path, err := exec.LookPath(iperfCmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := ioutil.ReadFile(path + ".args")
+	if err != nil {
+		t.Fatal(err)
+	}
+	args := strings.Fields(string(out))
+	if argValue(args, "-c") != "127.0.0.1" || argValue(args, "-t") != "1" {
+		t.Errorf("self-test ran %q, want a one second test of 127.0.0.1", args)
+	}
+}
+
+func TestRunSelfTestFailure(t *testing.T) {
+	defer fakeIperf3(t, 1)()
+	if err := runSelfTest(); err == nil {
+		t.Error("self-test of a refused connection succeeded")
+	}
+}
@@ -0,0 +1,157 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// iperf2Client runs probes with iperf2 and parses its CSV report. iperf2 only
+// reports what the client sent, so the received metrics are left at zero.
+type iperf2Client struct{}
+
+// Command implements iperfClient.
+func (iperf2Client) Command() string {
+	return iperf2Cmd
+}
+
+// Args implements iperfClient. iperf2 has no connect timeout, so the probe
+// connect timeout is ignored.
+func (iperf2Client) Args(c probeConfig) ([]string, error) {
+	if c.omit > 0 {
+		return nil, errors.New("'omit' parameter is not supported by iperf2")
+	}
+	if c.serverOutput {
+		return nil, errors.New("'get_server_output' parameter is not supported by iperf2")
+	}
+	if c.udp {
+		return nil, errors.New("'udp_mode' parameter is not supported by iperf2")
+	}
+	if c.sctp {
+		return nil, errors.New("'sctp' parameter is not supported by iperf2")
+	}
+	if c.bidir {
+		return nil, errors.New("'bidir' parameter is not supported by iperf2")
+	}
+	if c.reverse {
+		return nil, errors.New("'reverse' parameter is not supported by iperf2")
+	}
+	if c.fqRate != "" {
+		return nil, errors.New("'fq_rate' parameter is not supported by iperf2")
+	}
+	if c.pacingTimer > 0 {
+		return nil, errors.New("'pacing_timer' parameter is not supported by iperf2")
+	}
+	if c.bindDev != "" {
+		return nil, errors.New("'bind_dev' parameter is not supported by iperf2")
+	}
+	if c.clientPort != 0 {
+		return nil, errors.New("'cport' parameter is not supported by iperf2")
+	}
+	if c.zeroCopy {
+		return nil, errors.New("'zerocopy' parameter is not supported by iperf2")
+	}
+	if c.title != "" {
+		return nil, errors.New("'title' parameter is not supported by iperf2")
+	}
+	if c.username != "" {
+		return nil, errors.New("authentication is not supported by iperf2")
+	}
+
+	args := []string{"-y", "C", "-c", c.target, "-p", strconv.Itoa(c.port), "-P", strconv.Itoa(c.parallel)}
+	switch {
+	case c.bytes != "":
+		args = append(args, "-n", c.bytes)
+	case c.blockCount > 0:
+		return nil, errors.New("'blockcount' parameter is not supported by iperf2")
+	default:
+		args = append(args, "-t", strconv.FormatFloat(c.period.Seconds(), 'f', 0, 64))
+	}
+	if c.bind != "" {
+		args = append(args, "-B", c.bind)
+	}
+	if c.window != "" {
+		args = append(args, "-w", c.window)
+	}
+	if c.mss != 0 {
+		args = append(args, "-M", strconv.Itoa(c.mss))
+	}
+	if c.length != "" {
+		args = append(args, "-l", c.length)
+	}
+	if c.ipVersion == "6" {
+		args = append(args, "-V")
+	}
+	if c.congestion != "" {
+		args = append(args, "-Z", c.congestion)
+	}
+	if c.tos != 0 {
+		args = append(args, "-S", strconv.Itoa(c.tos))
+	}
+	if c.bitrate != "" {
+		args = append(args, "-b", c.bitrate)
+	}
+	return args, nil
+}
+
+// Parse implements iperfClient. Each CSV record reads timestamp, source
+// address and port, destination address and port, transfer ID, interval,
+// transferred bytes and bits per second. The summary of parallel streams uses
+// transfer ID -1; otherwise the last record covers the whole run.
+func (iperf2Client) Parse(out []byte) (iperfResult, error) {
+	stats := iperfResult{}
+
+	records, err := csv.NewReader(strings.NewReader(string(out))).ReadAll()
+	if err != nil {
+		return stats, err
+	}
+	if len(records) == 0 {
+		return stats, errors.New("no report in iperf2 output")
+	}
+
+	record := records[len(records)-1]
+	for _, r := range records {
+		if len(r) > 5 && r[5] == "-1" {
+			record = r
+		}
+	}
+	if len(record) < 9 {
+		return stats, fmt.Errorf("unexpected iperf2 report %q", strings.Join(record, ","))
+	}
+
+	interval := strings.SplitN(record[6], "-", 2)
+	if len(interval) != 2 {
+		return stats, fmt.Errorf("unexpected iperf2 interval %q", record[6])
+	}
+	start, err := strconv.ParseFloat(interval[0], 64)
+	if err != nil {
+		return stats, err
+	}
+	end, err := strconv.ParseFloat(interval[1], 64)
+	if err != nil {
+		return stats, err
+	}
+	bytes, err := strconv.ParseFloat(record[7], 64)
+	if err != nil {
+		return stats, err
+	}
+
+	stats.End.SumSent.Seconds = end - start
+	stats.End.SumSent.Bytes = bytes
+	return stats, nil
+}
@@ -0,0 +1,124 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestIperf2Args(t *testing.T) {
+	base := probeConfig{target: "iperf.example.com", port: 5001, period: 5 * time.Second, parallel: 1, connectTimeout: 3 * time.Second}
+
+	tests := []struct {
+		name   string
+		config func(c *probeConfig)
+		want   []string
+	}{
+		{"tcp", func(c *probeConfig) {}, []string{"-y", "C", "-c", "iperf.example.com", "-p", "5001", "-P", "1", "-t", "5"}},
+		{"bitrate", func(c *probeConfig) { c.bitrate = "100M" }, []string{"-y", "C", "-c", "iperf.example.com", "-p", "5001", "-P", "1", "-t", "5", "-b", "100M"}},
+		{"bytes", func(c *probeConfig) { c.bytes = "10M" }, []string{"-y", "C", "-c", "iperf.example.com", "-p", "5001", "-P", "1", "-n", "10M"}},
+		{"ipv6", func(c *probeConfig) { c.ipVersion = "6" }, []string{"-y", "C", "-c", "iperf.example.com", "-p", "5001", "-P", "1", "-t", "5", "-V"}},
+		{"congestion", func(c *probeConfig) { c.congestion = "bbr" }, []string{"-y", "C", "-c", "iperf.example.com", "-p", "5001", "-P", "1", "-t", "5", "-Z", "bbr"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := base
+			test.config(&c)
+			got, err := iperf2Client{}.Args(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIperf2ArgsRejectsUnsupported(t *testing.T) {
+	base := probeConfig{target: "iperf.example.com", port: 5001, period: 5 * time.Second, parallel: 1}
+
+	for name, config := range map[string]func(c *probeConfig){
+		"udp_mode":   func(c *probeConfig) { c.udp = true },
+		"reverse":    func(c *probeConfig) { c.reverse = true },
+		"bidir":      func(c *probeConfig) { c.bidir = true },
+		"omit":       func(c *probeConfig) { c.omit = 1 },
+		"blockcount": func(c *probeConfig) { c.blockCount = 10 },
+		"bind_dev":   func(c *probeConfig) { c.bindDev = "eth0" },
+		"title":      func(c *probeConfig) { c.title = "scheduled" },
+	} {
+		c := base
+		config(&c)
+		if _, err := (iperf2Client{}).Args(c); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestIperf2Parse(t *testing.T) {
+	tests := []struct {
+		name    string
+		out     string
+		seconds float64
+		bytes   float64
+	}{
+		{
+			name:    "single stream",
+			out:     "20191017123456,10.0.0.1,54321,10.0.0.2,5001,3,0.0-10.0,1179648000,943718400\n",
+			seconds: 10,
+			bytes:   1179648000,
+		},
+		{
+			name: "parallel streams",
+			out: "20191017123456,10.0.0.1,54321,10.0.0.2,5001,4,0.0-10.0,589824000,471859200\n" +
+				"20191017123456,10.0.0.1,54322,10.0.0.2,5001,3,0.0-10.0,603979776,483183820\n" +
+				"20191017123456,10.0.0.1,0,10.0.0.2,5001,-1,0.0-10.0,1193803776,955043020\n",
+			seconds: 10,
+			bytes:   1193803776,
+		},
+		{
+			name: "summary before the last record",
+			out: "20191017123456,10.0.0.1,0,10.0.0.2,5001,-1,0.0-5.0,600000000,960000000\n" +
+				"20191017123456,10.0.0.1,54322,10.0.0.2,5001,3,0.0-5.0,300000000,480000000\n",
+			seconds: 5,
+			bytes:   600000000,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			stats, err := iperf2Client{}.Parse([]byte(test.out))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if stats.End.SumSent.Seconds != test.seconds || stats.End.SumSent.Bytes != test.bytes {
+				t.Errorf("got %v seconds and %v bytes, want %v and %v", stats.End.SumSent.Seconds, stats.End.SumSent.Bytes, test.seconds, test.bytes)
+			}
+		})
+	}
+}
+
+func TestIperf2ParseErrors(t *testing.T) {
+	for _, out := range []string{
+		"",
+		"20191017123456,10.0.0.1,54321\n",
+		"20191017123456,10.0.0.1,54321,10.0.0.2,5001,3,10.0,1179648000,943718400\n",
+		"20191017123456,10.0.0.1,54321,10.0.0.2,5001,3,0.0-10.0,lots,943718400\n",
+	} {
+		if _, err := (iperf2Client{}).Parse([]byte(out)); err == nil {
+			t.Errorf("expected an error parsing %q", out)
+		}
+	}
+}
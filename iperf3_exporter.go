@@ -15,13 +15,26 @@ package main
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"io"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
+	"os"
 	"os/exec"
+	"os/signal"
+	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
+	"syscall"
 	"time"
+	"unicode/utf8"
 
 	_ "net/http/pprof"
 
@@ -29,6 +42,7 @@ import (
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/prometheus/common/log"
 	"github.com/prometheus/common/version"
+	"golang.org/x/time/rate"
 	"gopkg.in/alecthomas/kingpin.v2"
 )
 
@@ -37,60 +51,656 @@ const (
 )
 
 var (
-	listenAddress = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9579").String()
-	metricsPath   = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
-	timeout       = kingpin.Flag("iperf3.timeout", "iperf3 run timeout.").Default("30s").Duration()
+	listenAddress       = kingpin.Flag("web.listen-address", "Address to listen on for web interface and telemetry.").Default(":9579").String()
+	systemdSocket       = kingpin.Flag("web.systemd-socket", "Use systemd socket activation listeners instead of port listeners (Linux only).").Bool()
+	metricsPath         = kingpin.Flag("web.telemetry-path", "Path under which to expose metrics.").Default("/metrics").String()
+	timeout             = kingpin.Flag("iperf3.timeout", "iperf3 run timeout.").Default("30s").Duration()
+	connectTimeout      = kingpin.Flag("iperf3.connect-timeout", "Default iperf3 timeout for establishing the control connection, 0 disables it. Requires iperf3 3.6 or later.").Default("0s").Duration()
+	binary              = kingpin.Flag("iperf3.binary", "iperf client to probe with, iperf3 or iperf for iperf2 servers.").Default("iperf3").Enum("iperf3", "iperf")
+	sigFigs             = kingpin.Flag("metric.round-sigfigs", "Round probe results to this many significant figures, 0 exports exact values.").Default("0").Int()
+	degradedRetransmits = kingpin.Flag("state.degraded-retransmits", "Report the probe state as degraded above this many retransmits, 0 disables the check.").Default("0").Float64()
+	degradedBandwidth   = kingpin.Flag("state.degraded-bandwidth", "Report the probe state as degraded below this many received bits per second, 0 disables the check.").Default("0").Float64()
+	degradedLoss        = kingpin.Flag("state.degraded-loss-percent", "Report the state of UDP probes as degraded above this percentage of lost packets, 0 disables the check.").Default("0").Float64()
+	cacheTTL            = kingpin.Flag("iperf3.cache-ttl", "Reuse the result of an identical probe run within this duration instead of running iperf3 again, 0 disables caching.").Default("0s").Duration()
+	maxConcurrent       = kingpin.Flag("iperf3.max-concurrent", "Maximum number of probes running at once, further probes are rejected with 429 Too Many Requests. 0 means unlimited.").Default("0").Int()
+	targetAllowlistFlag = kingpin.Flag("iperf3.target-allowlist", "Comma-separated host names, IP addresses and CIDR networks that may be probed, empty allows any target.").Default("").String()
+	retries             = kingpin.Flag("iperf3.retries", "Default number of times to retry iperf3 runs failing with a transient network error.").Default("0").Int()
+	defaultPeriod       = kingpin.Flag("iperf3.default-period", "Default iperf3 test period used when none is requested.").Default("5s").Duration()
+	defaultBitrate      = kingpin.Flag("iperf3.default-bitrate", "Default iperf3 target bitrate used when none is requested, empty uses the iperf3 default.").Default("").String()
+	configFile          = kingpin.Flag("config.file", "YAML configuration file setting defaults for the flags below, flags given on the command line take precedence.").Default("").String()
+	shutdownGrace       = kingpin.Flag("web.shutdown-grace-period", "Time given to in-flight probes to complete on shutdown before they are cancelled.").Default("30s").Duration()
+	rateLimit           = kingpin.Flag("iperf3.rate-limit", "Maximum rate of probe requests per second, further requests are rejected with 429 Too Many Requests. 0 means unlimited.").Default("0").Float64()
+	authUsername        = kingpin.Flag("iperf3.username", "Username authenticating with iperf3 servers (iperf3 3.7 or later), the password is read by iperf3 from the IPERF3_PASSWORD environment variable.").Default("").String()
+	authPublicKey       = kingpin.Flag("iperf3.rsa-public-key-path", "Path to the RSA public key encrypting the credentials sent to iperf3 servers, required with --iperf3.username.").Default("").String()
+	maxTimeout          = kingpin.Flag("iperf3.max-timeout", "Maximum probe timeout taken from the Prometheus scrape timeout, 0 limits it to --iperf3.timeout.").Default("0s").Duration()
+	extraArgs           = kingpin.Flag("iperf3.extra-args", "Additional argument passed to every iperf run, may be repeated. Only letters, digits and _ . , : = / + - are allowed.").Strings()
+	logFile             = kingpin.Flag("log.file", "File to append the logs to instead of standard error, e.g. when run by systemd, with a --log.format logging to stderr. Rotation is left to tools such as logrotate.").Default("").String()
+	perTargetLimit      = kingpin.Flag("web.probe-concurrency-per-target", "Maximum number of probes of the same target and port running at once.").Default("1").Int()
+	perTargetQueue      = kingpin.Flag("web.probe-queue-per-target", "Maximum number of probes waiting for the same target and port, further probes are rejected with 429 Too Many Requests. 0 means unlimited.").Default("0").Int()
+	perTargetWait       = kingpin.Flag("web.probe-queue-timeout", "Maximum time a probe waits for other probes of the same target and port, 0 waits up to the probe timeout.").Default("0s").Duration()
+	selfTest            = kingpin.Flag("iperf3.selftest", "Probe an iperf3 server on 127.0.0.1 at startup and log the result, to catch misconfiguration at deploy time.").Bool()
+	selfTestFatal       = kingpin.Flag("iperf3.selftest-fatal", "Exit if the startup self-test fails.").Bool()
+	routePrefix         = kingpin.Flag("web.route-prefix", "Prefix of all the HTTP endpoints, e.g. /iperf3 when mounted under a path by a reverse proxy.").Default("/").String()
+	errorInterval       = kingpin.Flag("log.error-interval", "Minimum interval between repeated probe error logs for the same target, 0 logs every error.").Default("0s").Duration()
+
+	// Commands of the exporter, serving probes by default.
+	serveCommand       = kingpin.Command("serve", "Serve the probes and metrics.").Default()
+	checkConfigCommand = kingpin.Command("check-config", "Check the configuration file and flags, then exit without serving.")
 
 	// Metrics about the iperf3 exporter itself.
-	iperfDuration = prometheus.NewSummary(prometheus.SummaryOpts{Name: prometheus.BuildFQName(namespace, "exporter", "duration_seconds"), Help: "Duration of collections by the iperf3 exporter."})
-	iperfErrors   = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "errors_total"), Help: "Errors raised by the iperf3 exporter."})
+	iperfDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{Name: prometheus.BuildFQName(namespace, "exporter", "duration_seconds"), Help: "Duration of collections by the iperf3 exporter.", Buckets: []float64{1, 2.5, 5, 10, 15, 20, 30, 45, 60, 120, 300}}, []string{"target", "protocol"})
+	iperfInFlight = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "in_flight_probes"), Help: "Number of probes being handled by the iperf3 exporter."})
+	iperfErrors   = prometheus.NewCounterVec(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "exporter", "errors_total"), Help: "Errors raised by the iperf3 exporter."}, []string{"reason"})
+	iperfRetries  = prometheus.NewCounterVec(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "probe", "retries_total"), Help: "Retries of failed iperf runs, to spot flaky targets."}, []string{"target"})
+	iperfCancels  = prometheus.NewCounter(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "probe", "cancelled_total"), Help: "Probes cancelled before completing, e.g. because the client disconnected, as opposed to timing out."})
+
+	// Traffic of all the iperf runs, accumulated across probes.
+	sentBytesTotal     = prometheus.NewCounterVec(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "", "sent_bytes_total"), Help: "Total bytes sent by the iperf runs."}, []string{"target", "protocol"})
+	receivedBytesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{Name: prometheus.BuildFQName(namespace, "", "received_bytes_total"), Help: "Total bytes received by the iperf runs."}, []string{"target", "protocol"})
+
+	// Configuration of the iperf3 exporter, set once at startup.
+	configuredTimeout  = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "configured_timeout_seconds"), Help: "Configured iperf3 run timeout."})
+	defaultPeriodGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "default_period_seconds"), Help: "Default iperf3 test period used when none is requested."})
+	maxConcurrentGauge = prometheus.NewGauge(prometheus.GaugeOpts{Name: prometheus.BuildFQName(namespace, "exporter", "max_concurrent"), Help: "Maximum number of probes running at once, 0 means unlimited."})
+
+	// Client used to run the probes, selected by --iperf3.binary.
+	client iperfClient = iperf3Client{}
+
+	// Resolver of the target and bind host names.
+	resolver hostResolver = net.DefaultResolver
+
+	// Targets that may be probed, nil allows any target.
+	allowlist *targetAllowlist
+
+	// Locks limiting the concurrent probes of each target, set from
+	// --web.probe-concurrency-per-target.
+	probeLocks = newTargetLocks(1, 0)
+
+	// Slots of the probes in flight, nil when --iperf3.max-concurrent is unlimited.
+	probeSlots chan struct{}
+
+	// Recent probe results, kept for --iperf3.cache-ttl.
+	cache = newResultCache(0)
+
+	// Throttles probe error logs for persistently failing targets.
+	errorLogs = &errorLogLimiter{last: map[string]time.Time{}, suppressed: map[string]int{}}
+
+	// Probes in flight, cancelled if they outlast the shutdown grace period.
+	inFlightProbes = &probeCancels{cancels: map[uint64]context.CancelFunc{}}
+
+	// Resources flushed and closed once the HTTP server has stopped serving,
+	// in reverse order of registration.
+	closers []io.Closer
 )
 
+// hostResolver looks up the addresses of a host name, as net.Resolver does.
+type hostResolver interface {
+	LookupHost(ctx context.Context, host string) ([]string, error)
+}
+
 // iperfResult collects the partial result from the iperf3 run
 type iperfResult struct {
+	Error string `json:"error,omitempty"`
+	Start struct {
+		TestStart struct {
+			Blksize float64 `json:"blksize"`
+		} `json:"test_start"`
+	} `json:"start"`
+	Intervals []struct {
+		Streams []struct {
+			SndCwnd float64 `json:"snd_cwnd"`
+			RTTVar  float64 `json:"rttvar"`
+			PMTU    float64 `json:"pmtu"`
+		} `json:"streams"`
+		Sum struct {
+			BitsPerSecond float64 `json:"bits_per_second"`
+			// Only reported by the receiving side of UDP tests.
+			JitterMs *float64 `json:"jitter_ms,omitempty"`
+			Omitted  bool     `json:"omitted"`
+		} `json:"sum"`
+	} `json:"intervals"`
 	End struct {
 		SumSent struct {
 			Seconds     float64 `json:"seconds"`
 			Bytes       float64 `json:"bytes"`
 			Retransmits float64 `json:"retransmits"`
 		} `json:"sum_sent"`
-		SumReceived struct {
-			Seconds float64 `json:"seconds"`
-			Bytes   float64 `json:"bytes"`
-		} `json:"sum_received"`
+		SumReceived             receivedSum `json:"sum_received"`
+		SumReceivedBidirReverse receivedSum `json:"sum_received_bidir_reverse"`
+		Sum                     udpSum      `json:"sum"`
+		// Only reported by bidirectional tests, for the data sent by the
+		// server.
+		SumBidirReverse       udpSum `json:"sum_bidir_reverse"`
+		CPUUtilizationPercent struct {
+			HostTotal   float64 `json:"host_total"`
+			RemoteTotal float64 `json:"remote_total"`
+		} `json:"cpu_utilization_percent"`
+		Streams []struct {
+			Sender struct {
+				BitsPerSecond float64 `json:"bits_per_second"`
+				Retransmits   float64 `json:"retransmits"`
+				MeanRTT       float64 `json:"mean_rtt"`
+				MinRTT        float64 `json:"min_rtt"`
+				MaxRTT        float64 `json:"max_rtt"`
+			} `json:"sender"`
+			Receiver struct {
+				BitsPerSecond float64 `json:"bits_per_second"`
+			} `json:"receiver"`
+		} `json:"streams"`
 	} `json:"end"`
+	ServerOutputJSON *struct {
+		Start struct {
+			Version    string `json:"version"`
+			SystemInfo string `json:"system_info"`
+		} `json:"start"`
+		End struct {
+			CPUUtilizationPercent struct {
+				HostTotal float64 `json:"host_total"`
+			} `json:"cpu_utilization_percent"`
+		} `json:"end"`
+	} `json:"server_output_json"`
+	// Wall time of the iperf run, measured by the exporter.
+	Duration float64 `json:"duration_seconds,omitempty"`
+	// Exit code of a failed iperf run.
+	ExitCode int `json:"-"`
+}
+
+// receivedSum is the summary of the data received in one direction.
+type receivedSum struct {
+	Seconds float64 `json:"seconds"`
+	Bytes   float64 `json:"bytes"`
+}
+
+// udpSum is the summary of a UDP test in one direction.
+type udpSum struct {
+	Seconds     float64 `json:"seconds"`
+	Bytes       float64 `json:"bytes"`
+	JitterMs    float64 `json:"jitter_ms"`
+	LostPackets float64 `json:"lost_packets"`
+	Packets     float64 `json:"packets"`
+	LostPercent float64 `json:"lost_percent"`
+}
+
+// intervalStats returns the minimum, maximum and standard deviation of the
+// sent bits per second across the reported intervals, ignoring omitted ones.
+func (r iperfResult) intervalStats() (min, max, stddev float64, ok bool) {
+	var values []float64
+	for _, i := range r.Intervals {
+		if !i.Sum.Omitted {
+			values = append(values, i.Sum.BitsPerSecond)
+		}
+	}
+	if len(values) == 0 {
+		return 0, 0, 0, false
+	}
+	min, max, stddev = spread(values)
+	return min, max, stddev, true
+}
+
+// jitterStats returns the minimum, maximum and standard deviation of the UDP
+// jitter in milliseconds across the reported intervals, ignoring omitted ones.
+// It needs at least two intervals reporting the jitter.
+func (r iperfResult) jitterStats() (min, max, stddev float64, ok bool) {
+	var values []float64
+	for _, i := range r.Intervals {
+		if !i.Sum.Omitted && i.Sum.JitterMs != nil {
+			values = append(values, *i.Sum.JitterMs)
+		}
+	}
+	if len(values) < 2 {
+		return 0, 0, 0, false
+	}
+	min, max, stddev = spread(values)
+	return min, max, stddev, true
+}
+
+// spread returns the minimum, maximum and standard deviation of values, which
+// must not be empty.
+func spread(values []float64) (min, max, stddev float64) {
+	min, max = values[0], values[0]
+	var sum float64
+	for _, v := range values {
+		min = math.Min(min, v)
+		max = math.Max(max, v)
+		sum += v
+	}
+	mean := sum / float64(len(values))
+	var squares float64
+	for _, v := range values {
+		squares += (v - mean) * (v - mean)
+	}
+	return min, max, math.Sqrt(squares / float64(len(values)))
+}
+
+// serverInfo returns the iperf3 version and operating system of the server,
+// which are only reported when the server output was requested.
+func (r iperfResult) serverInfo() (serverVersion string, serverOS string, ok bool) {
+	if r.ServerOutputJSON == nil || r.ServerOutputJSON.Start.Version == "" {
+		return "", "", false
+	}
+	// The system info is the server's uname, keep only the kernel name to
+	// leave its hostname and kernel build out of the labels.
+	if fields := strings.Fields(r.ServerOutputJSON.Start.SystemInfo); len(fields) > 0 {
+		serverOS = fields[0]
+	}
+	return r.ServerOutputJSON.Start.Version, serverOS, true
+}
+
+// received returns the summary of the data received by the exporter, which
+// in bidirectional tests is the data sent by the server rather than what the
+// server received from the exporter.
+func (r iperfResult) received(bidir bool) receivedSum {
+	if bidir {
+		return r.End.SumReceivedBidirReverse
+	}
+	return r.End.SumReceived
+}
+
+// remoteCPU returns the total CPU utilization of the server, as reported to
+// the client, or else from the server output if it was requested.
+func (r iperfResult) remoteCPU() float64 {
+	if r.End.CPUUtilizationPercent.RemoteTotal == 0 && r.ServerOutputJSON != nil {
+		return r.ServerOutputJSON.End.CPUUtilizationPercent.HostTotal
+	}
+	return r.End.CPUUtilizationPercent.RemoteTotal
+}
+
+// meanRTT returns the mean round-trip time in seconds averaged across the
+// streams reporting it, or zero if none does (UDP and older iperf3 versions).
+func (r iperfResult) meanRTT() float64 {
+	var sum, n float64
+	for _, s := range r.End.Streams {
+		if s.Sender.MeanRTT > 0 {
+			sum += s.Sender.MeanRTT
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / n / 1e6
+}
+
+// retransmitRate returns the number of retransmits per megabyte sent, or zero
+// if nothing was sent.
+func (r iperfResult) retransmitRate() float64 {
+	if r.End.SumSent.Bytes <= 0 {
+		return 0
+	}
+	return r.End.SumSent.Retransmits / (r.End.SumSent.Bytes / 1e6)
+}
+
+// pmtu returns the path MTU of the first stream in the last interval, as
+// iperf3 doesn't report it in the end summary, or zero if it isn't reported.
+func (r iperfResult) pmtu() float64 {
+	if len(r.Intervals) == 0 || len(r.Intervals[len(r.Intervals)-1].Streams) == 0 {
+		return 0
+	}
+	return r.Intervals[len(r.Intervals)-1].Streams[0].PMTU
+}
+
+// sndCwnd returns the TCP congestion window in bytes at the end of the test,
+// summed across the streams of the last interval, or zero if it isn't
+// reported.
+func (r iperfResult) sndCwnd() float64 {
+	if len(r.Intervals) == 0 {
+		return 0
+	}
+	var sum float64
+	for _, s := range r.Intervals[len(r.Intervals)-1].Streams {
+		sum += s.SndCwnd
+	}
+	return sum
+}
+
+// rttVar returns the TCP round-trip time variation in seconds at the end of
+// the test, averaged across the streams reporting it, or zero if none does.
+func (r iperfResult) rttVar() float64 {
+	if len(r.Intervals) == 0 {
+		return 0
+	}
+	var sum, n float64
+	for _, s := range r.Intervals[len(r.Intervals)-1].Streams {
+		if s.RTTVar > 0 {
+			sum += s.RTTVar
+			n++
+		}
+	}
+	if n == 0 {
+		return 0
+	}
+	return sum / n / 1e6
+}
+
+// rttRange returns the minimum and maximum round-trip times in seconds across
+// all streams, or false if no stream reports them.
+func (r iperfResult) rttRange() (min, max float64, ok bool) {
+	for _, s := range r.End.Streams {
+		if s.Sender.MaxRTT <= 0 {
+			continue
+		}
+		if !ok || s.Sender.MinRTT < min {
+			min = s.Sender.MinRTT
+		}
+		if !ok || s.Sender.MaxRTT > max {
+			max = s.Sender.MaxRTT
+		}
+		ok = true
+	}
+	return min / 1e6, max / 1e6, ok
+}
+
+// bandwidthDelayProduct returns the received throughput multiplied by the mean
+// round-trip time in bytes, or zero if either is unknown.
+func (r iperfResult) bandwidthDelayProduct() float64 {
+	if r.End.SumReceived.Seconds <= 0 {
+		return 0
+	}
+	return r.End.SumReceived.Bytes / r.End.SumReceived.Seconds * r.meanRTT()
+}
+
+// probeConfig holds the parameters of a single iperf3 run.
+type probeConfig struct {
+	target   string
+	port     int
+	period   time.Duration
+	timeout  time.Duration
+	parallel int
+	bind     string
+	// Network interface the test traffic is bound to.
+	bindDev string
+	// Source port of the first stream, further streams use the next ports.
+	clientPort int
+	window     string
+	mss        int
+	length     string
+	omit       int
+	ipVersion  string
+	congestion string
+	tos        int
+	// Whether to retrieve the server side results along with the client's.
+	serverOutput   bool
+	connectTimeout time.Duration
+	udp            bool
+	sctp           bool
+	bitrate        string
+	// Fair-queue socket pacing rate.
+	fqRate string
+	// Interval of the iperf3 pacing timer, in microseconds.
+	pacingTimer int
+	// Number of times to retry runs failing with a transient error.
+	retries int
+	// Whether to test both directions at once.
+	bidir bool
+	// Whether the server sends and the client receives.
+	reverse bool
+	// Whether to send with sendfile instead of copying the data.
+	zeroCopy bool
+	// Number of bytes or blocks to transmit instead of running for the
+	// period.
+	bytes      string
+	blockCount int
+	// Whether to export per-stream metrics, which doesn't change the run.
+	perStream bool
+	// Title tagging the run, also exported as a label.
+	title string
+	// Credentials of authenticated servers, the password is passed to iperf3
+	// in its environment.
+	username     string
+	rsaPublicKey string
+}
+
+// protocol returns the transport protocol of the probe.
+func (c probeConfig) protocol() string {
+	switch {
+	case c.udp:
+		return "udp"
+	case c.sctp:
+		return "sctp"
+	default:
+		return "tcp"
+	}
+}
+
+// iperfClient builds the command line for, and parses the output of, one
+// flavour of the iperf client.
+type iperfClient interface {
+	// Command returns the name of the client binary.
+	Command() string
+	// Args returns the command-line arguments running the probe, or an error
+	// if the probe uses options the client doesn't support.
+	Args(c probeConfig) ([]string, error)
+	// Parse extracts the probe results from the client output.
+	Parse(out []byte) (iperfResult, error)
+}
+
+// buildArgs returns the command-line arguments of the iperf run of the probe,
+// followed by the --iperf3.extra-args.
+func buildArgs(c probeConfig) ([]string, error) {
+	args, err := client.Args(c)
+	if err != nil {
+		return nil, err
+	}
+	return append(args, *extraArgs...), nil
+}
+
+// iperf3Client runs probes with iperf3 and parses its JSON output.
+type iperf3Client struct{}
+
+// Command implements iperfClient.
+func (iperf3Client) Command() string {
+	return iperfCmd
+}
+
+// Args implements iperfClient.
+func (iperf3Client) Args(c probeConfig) ([]string, error) {
+	args := []string{"-J", "-i", "1", "-c", c.target, "-p", strconv.Itoa(c.port), "-P", strconv.Itoa(c.parallel)}
+	switch {
+	case c.bytes != "":
+		args = append(args, "-n", c.bytes)
+	case c.blockCount > 0:
+		args = append(args, "-k", strconv.Itoa(c.blockCount))
+	default:
+		args = append(args, "-t", strconv.FormatFloat(c.period.Seconds(), 'f', 0, 64))
+	}
+	if c.bind != "" {
+		args = append(args, "-B", c.bind)
+	}
+	if c.bindDev != "" {
+		args = append(args, "--bind-dev", c.bindDev)
+	}
+	if c.clientPort != 0 {
+		args = append(args, "--cport", strconv.Itoa(c.clientPort))
+	}
+	if c.window != "" {
+		args = append(args, "-w", c.window)
+	}
+	if c.mss != 0 {
+		args = append(args, "-M", strconv.Itoa(c.mss))
+	}
+	if c.length != "" {
+		args = append(args, "-l", c.length)
+	}
+	if c.omit > 0 {
+		args = append(args, "-O", strconv.Itoa(c.omit))
+	}
+	if c.ipVersion != "" {
+		args = append(args, "-"+c.ipVersion)
+	}
+	if c.congestion != "" {
+		args = append(args, "-C", c.congestion)
+	}
+	if c.tos != 0 {
+		args = append(args, "-S", strconv.Itoa(c.tos))
+	}
+	if c.serverOutput {
+		args = append(args, "--get-server-output")
+	}
+	if c.connectTimeout > 0 {
+		args = append(args, "--connect-timeout", strconv.FormatInt(int64(c.connectTimeout/time.Millisecond), 10))
+	}
+	if c.udp {
+		args = append(args, "-u")
+	}
+	if c.sctp {
+		args = append(args, "--sctp")
+	}
+	if c.bidir {
+		args = append(args, "--bidir")
+	}
+	if c.reverse {
+		args = append(args, "-R")
+	}
+	if c.zeroCopy {
+		args = append(args, "-Z")
+	}
+	if c.bitrate != "" {
+		args = append(args, "-b", c.bitrate)
+	}
+	if c.fqRate != "" {
+		args = append(args, "--fq-rate", c.fqRate)
+	}
+	if c.pacingTimer > 0 {
+		args = append(args, "--pacing-timer", strconv.Itoa(c.pacingTimer))
+	}
+	if c.title != "" {
+		args = append(args, "-T", c.title)
+	}
+	if c.username != "" {
+		args = append(args, "--username", c.username, "--rsa-public-key-path", c.rsaPublicKey)
+	}
+	return args, nil
+}
+
+// Parse implements iperfClient.
+func (iperf3Client) Parse(out []byte) (iperfResult, error) {
+	stats := iperfResult{}
+	if err := json.Unmarshal(out, &stats); err != nil {
+		return stats, err
+	}
+
+	// Older iperf3 versions only report a single sum for UDP tests.
+	if stats.End.SumSent.Seconds == 0 && stats.End.Sum.Seconds > 0 {
+		stats.End.SumSent.Seconds = stats.End.Sum.Seconds
+		stats.End.SumSent.Bytes = stats.End.Sum.Bytes
+	}
+	return stats, nil
 }
 
 // Exporter collects iperf3 stats from the given address and exports them using
 // the prometheus metrics package.
 type Exporter struct {
-	target  string
-	port    int
-	period  time.Duration
-	timeout time.Duration
-	mutex   sync.RWMutex
-
-	success         *prometheus.Desc
-	sentSeconds     *prometheus.Desc
-	sentBytes       *prometheus.Desc
-	receivedSeconds *prometheus.Desc
-	receivedBytes   *prometheus.Desc
-	retransmits     *prometheus.Desc
-}
-
-// NewExporter returns an initialized Exporter.
-func NewExporter(target string, port int, period time.Duration, timeout time.Duration) *Exporter {
+	// Context of the probe request, cancelling it stops the iperf run.
+	ctx    context.Context
+	config probeConfig
+	mutex  sync.RWMutex
+	// Logger tagged with the ID of the probe request.
+	logger log.Logger
+
+	success           *prometheus.Desc
+	state             *prometheus.Desc
+	attempts          *prometheus.Desc
+	exitCode          *prometheus.Desc
+	runDuration       *prometheus.Desc
+	targetBitrate     *prometheus.Desc
+	dnsLookup         *prometheus.Desc
+	dnsResolved       *prometheus.Desc
+	sentSeconds       *prometheus.Desc
+	sentBytes         *prometheus.Desc
+	jitter            *prometheus.Desc
+	jitterMin         *prometheus.Desc
+	jitterMax         *prometheus.Desc
+	jitterStddev      *prometheus.Desc
+	lostPackets       *prometheus.Desc
+	packets           *prometheus.Desc
+	lostPercent       *prometheus.Desc
+	udpPacketLength   *prometheus.Desc
+	receivedSeconds   *prometheus.Desc
+	receivedBytes     *prometheus.Desc
+	retransmits       *prometheus.Desc
+	retransmitRate    *prometheus.Desc
+	meanRTT           *prometheus.Desc
+	rttVar            *prometheus.Desc
+	minRTT            *prometheus.Desc
+	maxRTT            *prometheus.Desc
+	sndCwnd           *prometheus.Desc
+	pmtu              *prometheus.Desc
+	bdp               *prometheus.Desc
+	hostCPUTotal      *prometheus.Desc
+	remoteCPUTotal    *prometheus.Desc
+	serverInfo        *prometheus.Desc
+	streamSentBps     *prometheus.Desc
+	streamReceivedBps *prometheus.Desc
+	streamRetransmits *prometheus.Desc
+	sentBpsMin        *prometheus.Desc
+	sentBpsMax        *prometheus.Desc
+	sentBpsStddev     *prometheus.Desc
+}
+
+// NewExporter returns an initialized Exporter. The extra labels are added to
+// all its metrics.
+func NewExporter(ctx context.Context, config probeConfig, labels map[string]string) *Exporter {
+	constLabels := prometheus.Labels{"protocol": config.protocol()}
+	if config.title != "" {
+		constLabels["title"] = config.title
+	}
+	for name, value := range labels {
+		constLabels[name] = value
+	}
+	// Both directions of bidirectional UDP tests have their own loss and
+	// jitter, told apart by a direction label.
+	var lossLabels []string
+	if config.udp && config.bidir {
+		lossLabels = []string{"direction"}
+	}
+	// The run duration is labelled by the target and port it was measured
+	// against, so it can be compared across exporters probing them.
+	durationLabels := prometheus.Labels{"target": config.target, "port": strconv.Itoa(config.port)}
+	for name, value := range constLabels {
+		durationLabels[name] = value
+	}
 	return &Exporter{
-		target:          target,
-		port:            port,
-		period:          period,
-		timeout:         timeout,
-		success:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "success"), "Was the last iperf3 probe successful.", nil, nil),
-		sentSeconds:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sent_seconds"), "Total seconds spent sending packets.", nil, nil),
-		sentBytes:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sent_bytes"), "Total sent bytes.", nil, nil),
-		receivedSeconds: prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "received_seconds"), "Total seconds spent receiving packets.", nil, nil),
-		receivedBytes:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "received_bytes"), "Total received bytes.", nil, nil),
-		retransmits:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "retransmits"), "Total retransmits", nil, nil),
+		ctx:               ctx,
+		config:            config,
+		logger:            requestLogger(ctx),
+		success:           prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "success"), "Was the last iperf3 probe successful.", nil, constLabels),
+		state:             prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "state"), "State of the last iperf3 probe: up, degraded or down.", []string{"state"}, constLabels),
+		attempts:          prometheus.NewDesc(prometheus.BuildFQName(namespace, "probe", "attempts"), "Number of iperf runs attempted by the probe.", nil, constLabels),
+		exitCode:          prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "exit_code"), "Exit code of the failed iperf run of the probe, 128 plus the signal number if it was killed and -1 if it couldn't start.", nil, constLabels),
+		runDuration:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "probe", "duration_seconds"), "Wall time of the successful iperf run of the probe, excluding the exporter overhead. Results served from the cache report the duration of the run that produced them.", nil, durationLabels),
+		targetBitrate:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "target_bitrate_bits_per_second"), "Target bitrate requested for the test, when set.", nil, constLabels),
+		dnsLookup:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "dns", "lookup_seconds"), "Duration of the DNS lookup of the target.", nil, constLabels),
+		dnsResolved:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "dns", "resolved"), "Whether the target host name was resolved.", nil, constLabels),
+		sentSeconds:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sent_seconds"), "Total seconds spent sending packets.", nil, constLabels),
+		sentBytes:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sent_bytes"), "Total sent bytes.", nil, constLabels),
+		jitter:            prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "received_jitter_ms"), "UDP jitter in milliseconds.", lossLabels, constLabels),
+		jitterMin:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "received_jitter_ms_min"), "Minimum UDP jitter in milliseconds across the test intervals.", nil, constLabels),
+		jitterMax:         prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "received_jitter_ms_max"), "Maximum UDP jitter in milliseconds across the test intervals.", nil, constLabels),
+		jitterStddev:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "received_jitter_ms_stddev"), "Standard deviation of the UDP jitter in milliseconds across the test intervals.", nil, constLabels),
+		lostPackets:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "lost_packets"), "Total lost UDP packets.", lossLabels, constLabels),
+		packets:           prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "packets"), "Total sent UDP packets.", lossLabels, constLabels),
+		lostPercent:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "lost_percent"), "Percentage of lost UDP packets.", lossLabels, constLabels),
+		udpPacketLength:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "udp_packet_length_bytes"), "Length of the UDP datagrams sent.", nil, constLabels),
+		receivedSeconds:   prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "received_seconds"), "Total seconds spent receiving packets.", nil, constLabels),
+		receivedBytes:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "received_bytes"), "Total received bytes.", nil, constLabels),
+		retransmits:       prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "retransmits"), "Total retransmits", nil, constLabels),
+		retransmitRate:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "retransmit_rate"), "Retransmits per megabyte sent.", nil, constLabels),
+		sentBpsMin:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sent_bps_min"), "Minimum sent bits per second across the test intervals.", nil, constLabels),
+		sentBpsMax:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sent_bps_max"), "Maximum sent bits per second across the test intervals.", nil, constLabels),
+		sentBpsStddev:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "sent_bps_stddev"), "Standard deviation of the sent bits per second across the test intervals.", nil, constLabels),
+		streamSentBps:     prometheus.NewDesc(prometheus.BuildFQName(namespace, "stream", "sent_bps"), "Sent bits per second of each stream.", []string{"stream"}, constLabels),
+		streamReceivedBps: prometheus.NewDesc(prometheus.BuildFQName(namespace, "stream", "received_bps"), "Received bits per second of each stream.", []string{"stream"}, constLabels),
+		streamRetransmits: prometheus.NewDesc(prometheus.BuildFQName(namespace, "stream", "retransmits"), "Retransmits of each stream.", []string{"stream"}, constLabels),
+		serverInfo:        prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "server_info"), "iperf3 server version and operating system, when the server output is requested.", []string{"version", "os"}, constLabels),
+		hostCPUTotal:      prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "host_cpu_total_percent"), "Total CPU utilization of the exporter host during the test.", nil, constLabels),
+		remoteCPUTotal:    prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "remote_cpu_total_percent"), "Total CPU utilization of the iperf3 server during the test.", nil, constLabels),
+		meanRTT:           prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "mean_rtt_ms"), "Mean TCP round-trip time in milliseconds, averaged across streams.", nil, constLabels),
+		rttVar:            prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "rttvar_ms"), "TCP round-trip time variation in milliseconds at the end of the test, averaged across streams.", nil, constLabels),
+		minRTT:            prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "min_rtt_ms"), "Minimum TCP round-trip time in milliseconds across streams.", nil, constLabels),
+		maxRTT:            prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "max_rtt_ms"), "Maximum TCP round-trip time in milliseconds across streams.", nil, constLabels),
+		sndCwnd:           prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "snd_cwnd_bytes"), "TCP congestion window at the end of the test, summed across streams.", nil, constLabels),
+		pmtu:              prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "pmtu_bytes"), "Path MTU of the first stream in the last test interval.", nil, constLabels),
+		bdp:               prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "bandwidth_delay_product_bytes"), "Received throughput multiplied by the mean round-trip time.", nil, constLabels),
 	}
 }
 
@@ -98,11 +708,43 @@ func NewExporter(target string, port int, period time.Duration, timeout time.Dur
 // implements prometheus.Collector.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
 	ch <- e.success
+	ch <- e.state
+	ch <- e.attempts
+	ch <- e.exitCode
+	ch <- e.runDuration
+	ch <- e.targetBitrate
+	ch <- e.dnsLookup
+	ch <- e.dnsResolved
 	ch <- e.sentSeconds
 	ch <- e.sentBytes
+	ch <- e.jitter
+	ch <- e.jitterMin
+	ch <- e.jitterMax
+	ch <- e.jitterStddev
+	ch <- e.lostPackets
+	ch <- e.packets
+	ch <- e.lostPercent
+	ch <- e.udpPacketLength
 	ch <- e.receivedSeconds
 	ch <- e.receivedBytes
 	ch <- e.retransmits
+	ch <- e.retransmitRate
+	ch <- e.hostCPUTotal
+	ch <- e.remoteCPUTotal
+	ch <- e.meanRTT
+	ch <- e.rttVar
+	ch <- e.minRTT
+	ch <- e.maxRTT
+	ch <- e.sndCwnd
+	ch <- e.pmtu
+	ch <- e.bdp
+	ch <- e.serverInfo
+	ch <- e.streamSentBps
+	ch <- e.streamReceivedBps
+	ch <- e.streamRetransmits
+	ch <- e.sentBpsMin
+	ch <- e.sentBpsMax
+	ch <- e.sentBpsStddev
 }
 
 // Collect probes the configured iperf3 server and delivers them as Prometheus
@@ -111,145 +753,1577 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 	e.mutex.Lock() // To protect metrics from concurrent collects.
 	defer e.mutex.Unlock()
 
-	ctx, cancel := context.WithTimeout(context.Background(), e.timeout)
-	defer cancel()
+	// Resolve the target first to fail fast, rather than spending the whole
+	// timeout inside iperf.
+	if net.ParseIP(e.config.target) == nil {
+		start := time.Now()
+		_, err := resolver.LookupHost(e.ctx, e.config.target)
+		ch <- newGauge(e.dnsLookup, time.Since(start).Seconds())
+		if err != nil {
+			ch <- newGauge(e.dnsResolved, 0)
+			ch <- newGauge(e.success, 0)
+			ch <- newGauge(e.state, 1, "down")
+			iperfErrors.WithLabelValues("dns").Inc()
+			errorLogs.Errorf(e.logger, e.config.target, "dns", "Failed to resolve %s: %s", e.config.target, err)
+			return
+		}
+		ch <- newGauge(e.dnsResolved, 1)
+	}
 
-	out, err := exec.CommandContext(ctx, iperfCmd, "-J", "-t", strconv.FormatFloat(e.period.Seconds(), 'f', 0, 64), "-c", e.target, "-p", strconv.Itoa(e.port)).Output()
-	if err != nil {
-		ch <- prometheus.MustNewConstMetric(e.success, prometheus.GaugeValue, 0)
-		iperfErrors.Inc()
-		log.Errorf("Failed to run iperf3: %s", err)
-		return
+	stats, ok := cache.get(e.config)
+	if !ok {
+		var attempts int
+		var err error
+		stats, attempts, err = e.probe()
+		ch <- newGauge(e.attempts, float64(attempts))
+		if err != nil {
+			if stats.ExitCode != 0 {
+				ch <- newGauge(e.exitCode, float64(stats.ExitCode))
+			}
+			ch <- newGauge(e.success, 0)
+			ch <- newGauge(e.state, 1, "down")
+			return
+		}
+		cache.set(e.config, stats)
 	}
 
-	stats := iperfResult{}
-	if err := json.Unmarshal(out, &stats); err != nil {
-		ch <- prometheus.MustNewConstMetric(e.success, prometheus.GaugeValue, 0)
-		iperfErrors.Inc()
-		log.Errorf("Failed to parse iperf3 result: %s", err)
-		return
+	ch <- newGauge(e.success, 1)
+	ch <- newGauge(e.state, 1, probeState(stats, e.config))
+	ch <- newGauge(e.runDuration, stats.Duration)
+	if rate, ok := parseBitrate(e.config.bitrate); ok {
+		ch <- newGauge(e.targetBitrate, rate)
+	}
+	ch <- newGauge(e.sentSeconds, stats.End.SumSent.Seconds)
+	ch <- newGauge(e.sentBytes, stats.End.SumSent.Bytes)
+	received := stats.received(e.config.bidir)
+	ch <- newGauge(e.receivedSeconds, received.Seconds)
+	ch <- newGauge(e.receivedBytes, received.Bytes)
+	ch <- newGauge(e.hostCPUTotal, stats.End.CPUUtilizationPercent.HostTotal)
+	ch <- newGauge(e.remoteCPUTotal, stats.remoteCPU())
+	switch e.config.protocol() {
+	case "udp":
+		if e.config.bidir {
+			e.collectLoss(ch, stats.End.Sum, "forward")
+			e.collectLoss(ch, stats.End.SumBidirReverse, "reverse")
+		} else {
+			e.collectLoss(ch, stats.End.Sum)
+		}
+		if min, max, stddev, ok := stats.jitterStats(); ok {
+			ch <- newGauge(e.jitterMin, min)
+			ch <- newGauge(e.jitterMax, max)
+			ch <- newGauge(e.jitterStddev, stddev)
+		}
+		if length := stats.Start.TestStart.Blksize; length > 0 {
+			ch <- newGauge(e.udpPacketLength, length)
+		}
+	case "tcp":
+		ch <- newGauge(e.retransmits, stats.End.SumSent.Retransmits)
+		ch <- newGauge(e.retransmitRate, stats.retransmitRate())
+		ch <- newGauge(e.meanRTT, stats.meanRTT()*1000)
+		ch <- newGauge(e.rttVar, stats.rttVar()*1000)
+		if min, max, ok := stats.rttRange(); ok {
+			ch <- newGauge(e.minRTT, min*1000)
+			ch <- newGauge(e.maxRTT, max*1000)
+		}
+		ch <- newGauge(e.sndCwnd, stats.sndCwnd())
+		ch <- newGauge(e.pmtu, stats.pmtu())
+		if bdp := stats.bandwidthDelayProduct(); bdp > 0 {
+			ch <- newGauge(e.bdp, bdp)
+		}
+	}
+	if min, max, stddev, ok := stats.intervalStats(); ok {
+		ch <- newGauge(e.sentBpsMin, min)
+		ch <- newGauge(e.sentBpsMax, max)
+		ch <- newGauge(e.sentBpsStddev, stddev)
+	}
+	if e.config.perStream {
+		for i, s := range stats.End.Streams {
+			stream := strconv.Itoa(i)
+			ch <- newGauge(e.streamSentBps, s.Sender.BitsPerSecond, stream)
+			ch <- newGauge(e.streamReceivedBps, s.Receiver.BitsPerSecond, stream)
+			if e.config.protocol() == "tcp" {
+				ch <- newGauge(e.streamRetransmits, s.Sender.Retransmits, stream)
+			}
+		}
+	}
+	if serverVersion, serverOS, ok := stats.serverInfo(); ok {
+		ch <- newGauge(e.serverInfo, 1, serverVersion, serverOS)
 	}
+}
 
-	ch <- prometheus.MustNewConstMetric(e.success, prometheus.GaugeValue, 1)
-	ch <- prometheus.MustNewConstMetric(e.sentSeconds, prometheus.GaugeValue, stats.End.SumSent.Seconds)
-	ch <- prometheus.MustNewConstMetric(e.sentBytes, prometheus.GaugeValue, stats.End.SumSent.Bytes)
-	ch <- prometheus.MustNewConstMetric(e.receivedSeconds, prometheus.GaugeValue, stats.End.SumReceived.Seconds)
-	ch <- prometheus.MustNewConstMetric(e.receivedBytes, prometheus.GaugeValue, stats.End.SumReceived.Bytes)
-	ch <- prometheus.MustNewConstMetric(e.retransmits, prometheus.GaugeValue, stats.End.SumSent.Retransmits)
+// collectLoss delivers the packet loss and jitter of a UDP test direction.
+func (e *Exporter) collectLoss(ch chan<- prometheus.Metric, sum udpSum, labelValues ...string) {
+	ch <- newGauge(e.jitter, sum.JitterMs, labelValues...)
+	ch <- newGauge(e.lostPackets, sum.LostPackets, labelValues...)
+	ch <- newGauge(e.packets, sum.Packets, labelValues...)
+	ch <- newGauge(e.lostPercent, sum.LostPercent, labelValues...)
 }
 
-func handler(w http.ResponseWriter, r *http.Request) {
-	target := r.URL.Query().Get("target")
-	if target == "" {
-		http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
-		iperfErrors.Inc()
-		return
+// probe runs iperf against the configured target and parses its result,
+// logging any failure. Runs failing with a retryable error are retried with
+// exponential backoff, up to the configured number of retries and within the
+// probe timeout. It returns the number of runs attempted.
+func (e *Exporter) probe() (iperfResult, int, error) {
+	ctx, cancel := context.WithTimeout(e.ctx, e.config.timeout)
+	defer cancel()
+
+	args, err := buildArgs(e.config)
+	if err != nil {
+		iperfErrors.WithLabelValues("validation").Inc()
+		errorLogs.Errorf(e.logger, e.config.target, "args", "Invalid iperf probe of %s: %s", e.config.target, err)
+		return iperfResult{}, 0, err
 	}
+	e.logger.Debugf("Running %s %s", client.Command(), strings.Join(args, " "))
 
-	var targetPort int
-	port := r.URL.Query().Get("port")
-	if port != "" {
-		var err error
-		targetPort, err = strconv.Atoi(port)
+	backoff := retryBackoff
+	for attempt := 1; ; attempt++ {
+		start := time.Now()
+		out, err := exec.CommandContext(ctx, client.Command(), args...).Output()
+		duration := time.Since(start)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("'port' parameter must be an integer: %s", err), http.StatusBadRequest)
-			iperfErrors.Inc()
-			return
+			msg := runError(out, err)
+			if attempt > e.config.retries || !retryable(msg) || !e.wait(ctx, backoff) {
+				if ctx.Err() == context.Canceled {
+					iperfCancels.Inc()
+				}
+				reason := runErrorReason(ctx, msg)
+				iperfErrors.WithLabelValues(reason).Inc()
+				errorLogs.Errorf(e.logger, e.config.target, reason, "Failed to run iperf against %s: %s", e.config.target, msg)
+				return iperfResult{ExitCode: exitCode(err)}, attempt, err
+			}
+			e.logger.Debugf("Retrying iperf against %s after attempt %d failed: %s", e.config.target, attempt, msg)
+			iperfRetries.WithLabelValues(e.config.target).Inc()
+			backoff *= 2
+			continue
 		}
-	}
-	if targetPort == 0 {
-		targetPort = 5201
-	}
 
-	var runPeriod time.Duration
-	period := r.URL.Query().Get("period")
-	if period != "" {
-		var err error
-		runPeriod, err = time.ParseDuration(period)
+		stats, err := client.Parse(out)
 		if err != nil {
-			http.Error(w, fmt.Sprintf("'period' parameter must be a duration: %s", err), http.StatusBadRequest)
-			iperfErrors.Inc()
-			return
+			iperfErrors.WithLabelValues("parse").Inc()
+			errorLogs.Errorf(e.logger, e.config.target, "parse", "Failed to parse iperf result for %s: %s", e.config.target, err)
+			return iperfResult{}, attempt, err
 		}
+		stats.Duration = duration.Seconds()
+
+		// Count the traffic of each run once, however many scrapes report it.
+		received := stats.received(e.config.bidir).Bytes
+		// The gauges of the run can't carry exemplars, the counters link
+		// the traffic to the trace of the probe instead.
+		sentBytesTotal.WithLabelValues(e.config.target, e.config.protocol()).(prometheus.ExemplarAdder).AddWithExemplar(stats.End.SumSent.Bytes, exemplar(e.ctx))
+		receivedBytesTotal.WithLabelValues(e.config.target, e.config.protocol()).(prometheus.ExemplarAdder).AddWithExemplar(received, exemplar(e.ctx))
+		return stats, attempt, nil
 	}
-	if runPeriod.Seconds() == 0 {
-		runPeriod = time.Second * 5
+}
+
+// wait sleeps for the backoff before retrying a failed run, and reports false
+// without waiting if another run wouldn't complete within the probe timeout.
+func (e *Exporter) wait(ctx context.Context, backoff time.Duration) bool {
+	if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < backoff+e.config.period {
+		return false
 	}
 
-	// If a timeout is configured via the Prometheus header, add it to the request.
-	var timeoutSeconds float64
-	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
-		var err error
-		timeoutSeconds, err = strconv.ParseFloat(v, 64)
-		if err != nil {
-			http.Error(w, fmt.Sprintf("Failed to parse timeout from Prometheus header: %s", err), http.StatusInternalServerError)
-			iperfErrors.Inc()
-			return
+	t := time.NewTimer(backoff)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// sequentialCollector collects its collectors one after the other, for iperf
+// runs that must not overlap.
+type sequentialCollector []prometheus.Collector
+
+// Describe describes the metrics of all the collectors. It implements
+// prometheus.Collector.
+func (s sequentialCollector) Describe(ch chan<- *prometheus.Desc) {
+	for _, c := range s {
+		c.Describe(ch)
+	}
+}
+
+// Collect collects the collectors in order. It implements
+// prometheus.Collector.
+func (s sequentialCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, c := range s {
+		c.Collect(ch)
+	}
+}
+
+// bothDirections returns a collector probing the target forward and then in
+// reverse, each run taking half the probe timeout, with the metrics of each
+// run labelled by its direction.
+func bothDirections(ctx context.Context, config probeConfig, labels map[string]string) sequentialCollector {
+	config.timeout /= 2
+	var runs sequentialCollector
+	for _, direction := range []string{"forward", "reverse"} {
+		runConfig := config
+		runConfig.reverse = direction == "reverse"
+		runLabels := map[string]string{"direction": direction}
+		for name, value := range labels {
+			runLabels[name] = value
 		}
+		runs = append(runs, NewExporter(ctx, runConfig, runLabels))
 	}
-	if timeoutSeconds == 0 {
-		if timeout.Seconds() > 0 {
-			timeoutSeconds = timeout.Seconds()
-		} else {
-			timeoutSeconds = 30
+	return runs
+}
+
+// errorReasons are the values of the reason label of the errors counter.
+var errorReasons = []string{"validation", "rejected", "dns", "connection_refused", "server_busy", "timeout", "run", "parse"}
+
+// runErrorReason classifies the error of a failed iperf run.
+func runErrorReason(ctx context.Context, msg string) string {
+	lower := strings.ToLower(msg)
+	switch {
+	case ctx.Err() == context.DeadlineExceeded:
+		return "timeout"
+	case strings.Contains(lower, "connection refused"):
+		return "connection_refused"
+	case strings.Contains(lower, serverBusyError):
+		return "server_busy"
+	case strings.Contains(lower, "name or service not known"), strings.Contains(lower, "no address associated"), strings.Contains(lower, "nodename nor servname"), strings.Contains(lower, "unknown host"), strings.Contains(lower, "temporary failure in name resolution"):
+		return "dns"
+	default:
+		return "run"
+	}
+}
+
+// retryBackoff is the wait before the first retry of a failed run, doubled
+// for each further retry.
+const retryBackoff = time.Second
+
+// serverBusyError is the iperf3 error of a server already running a test for
+// another client.
+const serverBusyError = "the server is busy running a test"
+
+// retryableErrors are the iperf errors caused by transient network failures,
+// or by a server busy with another test.
+var retryableErrors = []string{"connection refused", "connection reset", "no route to host", serverBusyError}
+
+// retryable reports whether an iperf run failing with the error may succeed
+// when retried.
+func retryable(msg string) bool {
+	msg = strings.ToLower(msg)
+	for _, e := range retryableErrors {
+		if strings.Contains(msg, e) {
+			return true
 		}
 	}
+	return false
+}
 
-	if timeoutSeconds > 30 {
-		timeoutSeconds = 30
+// probeState returns the state of a successful probe, degraded when it crossed
+// one of the configured thresholds and up otherwise. Packet loss is only
+// reported by UDP tests.
+func probeState(stats iperfResult, config probeConfig) string {
+	if *degradedRetransmits > 0 && stats.End.SumSent.Retransmits > *degradedRetransmits {
+		return "degraded"
 	}
+	// The received bandwidth is the one exported by the probe.
+	received := stats.received(config.bidir)
+	if *degradedBandwidth > 0 && received.Seconds > 0 && received.Bytes*8/received.Seconds < *degradedBandwidth {
+		return "degraded"
+	}
+	if *degradedLoss > 0 && config.protocol() == "udp" && (stats.End.Sum.LostPercent > *degradedLoss || stats.End.SumBidirReverse.LostPercent > *degradedLoss) {
+		return "degraded"
+	}
+	return "up"
+}
 
-	runTimeout := time.Duration(timeoutSeconds * float64(time.Second))
+// newGauge returns a constant gauge metric, rounded to --metric.round-sigfigs
+// significant figures when set.
+func newGauge(desc *prometheus.Desc, value float64, labelValues ...string) prometheus.Metric {
+	return prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, roundSigFigs(value, *sigFigs), labelValues...)
+}
 
-	start := time.Now()
-	registry := prometheus.NewRegistry()
-	exporter := NewExporter(target, targetPort, runPeriod, runTimeout)
-	registry.MustRegister(exporter)
+// roundSigFigs rounds value to n significant figures, leaving it unchanged if
+// n isn't positive.
+func roundSigFigs(value float64, n int) float64 {
+	if n <= 0 || value == 0 || math.IsInf(value, 0) || math.IsNaN(value) {
+		return value
+	}
+	scale := math.Pow(10, float64(n)-math.Ceil(math.Log10(math.Abs(value))))
+	return math.Round(value*scale) / scale
+}
 
-	// Delegate http serving to Prometheus client library, which will call collector.Collect.
-	h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{})
-	h.ServeHTTP(w, r)
+// runError describes a failed iperf run, preferring the error reported by
+// iperf3 in its JSON output, then anything written to stderr.
+func runError(out []byte, err error) string {
+	stats := iperfResult{}
+	if json.Unmarshal(out, &stats) == nil && stats.Error != "" {
+		return fmt.Sprintf("%s: %s", err, stats.Error)
+	}
+	if exitErr, ok := err.(*exec.ExitError); ok && len(exitErr.Stderr) > 0 {
+		return fmt.Sprintf("%s: %s", err, strings.TrimSpace(string(exitErr.Stderr)))
+	}
+	return err.Error()
+}
 
-	duration := time.Since(start).Seconds()
-	iperfDuration.Observe(duration)
+// exitCode returns the exit code of a failed iperf run, 128 plus the signal
+// number if it was killed, e.g. on timeout, and -1 if it couldn't start.
+func exitCode(err error) int {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return -1
+	}
+	if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+		return 128 + int(status.Signal())
+	}
+	return exitErr.ExitCode()
 }
 
-func main() {
-	log.AddFlags(kingpin.CommandLine)
-	kingpin.Version(version.Print("iperf3_exporter"))
-	kingpin.HelpFlag.Short('h')
-	kingpin.Parse()
+// errorLogLimiter logs the first error of each target and category, and then
+// at most one error per --log.error-interval, so a target that is down doesn't
+// flood the logs on every scrape.
+type errorLogLimiter struct {
+	mutex      sync.Mutex
+	last       map[string]time.Time
+	suppressed map[string]int
+}
 
-	log.Info("Starting iperf3 exporter", version.Info())
-	log.Info("Build context", version.BuildContext())
+// Errorf logs the error unless one of the same target and category was logged
+// within the configured interval.
+func (l *errorLogLimiter) Errorf(logger log.Logger, target, category, format string, args ...interface{}) {
+	if *errorInterval <= 0 {
+		logger.Errorf(format, args...)
+		return
+	}
 
-	prometheus.MustRegister(version.NewCollector("iperf3_exporter"))
-	prometheus.MustRegister(iperfDuration)
-	prometheus.MustRegister(iperfErrors)
+	key := target + "/" + category
+	now := time.Now()
 
-	http.Handle(*metricsPath, promhttp.Handler())
-	http.HandleFunc("/probe", handler)
+	l.mutex.Lock()
+	if last, ok := l.last[key]; ok && now.Sub(last) < *errorInterval {
+		l.suppressed[key]++
+		l.mutex.Unlock()
+		return
+	}
+	suppressed := l.suppressed[key]
+	l.last[key] = now
+	delete(l.suppressed, key)
 
-	http.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html")
-		_, err := w.Write([]byte(`<html>
-    <head><title>iPerf3 Exporter</title></head>
-    <body>
-    <h1>iPerf3 Exporter</h1>
-    <p><a href="/probe?target=prometheus.io">Probe prometheus.io</a></p>
-    <p><a href='` + *metricsPath + `'>Metrics</a></p>
-    </html>`))
-		if err != nil {
-			log.Warnf("Failed to write to HTTP client: %s", err)
+	// Forget targets that have stopped failing.
+	for k, t := range l.last {
+		if now.Sub(t) >= *errorInterval && k != key {
+			delete(l.last, k)
+			delete(l.suppressed, k)
 		}
-	})
+	}
+	l.mutex.Unlock()
 
-	srv := &http.Server{
-		Addr:         *listenAddress,
-		ReadTimeout:  60 * time.Second,
-		WriteTimeout: 60 * time.Second,
+	if suppressed > 0 {
+		format += fmt.Sprintf(" (%d similar errors suppressed)", suppressed)
+	}
+	logger.Errorf(format, args...)
+}
+
+// probeCancels tracks the cancel functions of the probes in flight, so they
+// can be interrupted when the exporter shuts down.
+type probeCancels struct {
+	mutex   sync.Mutex
+	next    uint64
+	cancels map[uint64]context.CancelFunc
+}
+
+// add tracks cancel until the returned function is called.
+func (p *probeCancels) add(cancel context.CancelFunc) func() {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	id := p.next
+	p.next++
+	p.cancels[id] = cancel
+	return func() {
+		p.mutex.Lock()
+		defer p.mutex.Unlock()
+		delete(p.cancels, id)
 	}
+}
+
+// cancelAll cancels the probes in flight and returns how many there were.
+func (p *probeCancels) cancelAll() int {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	for _, cancel := range p.cancels {
+		cancel()
+	}
+	return len(p.cancels)
+}
 
-	log.Infof("Listening on %s", srv.Addr)
-	log.Fatal(srv.ListenAndServe())
+// loggerKey is the context key of the logger of a probe request.
+type loggerKey struct{}
+
+// requestLogger returns the logger of the probe request of ctx, or the base
+// logger outside of probe requests.
+func requestLogger(ctx context.Context) log.Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(log.Logger); ok {
+		return logger
+	}
+	return log.Base()
+}
+
+// traceKey is the context key of the trace ID of a probe request.
+type traceKey struct{}
+
+// traceparentRegexp matches a W3C Trace Context traceparent header, capturing
+// its version, trace ID, parent ID and the fields of later versions.
+var traceparentRegexp = regexp.MustCompile(`^([0-9a-f]{2})-([0-9a-f]{32})-([0-9a-f]{16})-[0-9a-f]{2}(-.*)?$`)
+
+// parseTraceparent returns the trace ID of a traceparent header, or false if
+// it isn't a valid trace context. All-zero IDs are invalid, and version 00
+// has no further fields.
+func parseTraceparent(header string) (string, bool) {
+	m := traceparentRegexp.FindStringSubmatch(strings.TrimSpace(header))
+	if m == nil || m[1] == "ff" || (m[1] == "00" && m[4] != "") || strings.Trim(m[2], "0") == "" || strings.Trim(m[3], "0") == "" {
+		return "", false
+	}
+	return m[2], true
+}
+
+// exemplar returns the exemplar labels linking the metrics of the probe
+// request of ctx to its trace, or nil outside of a traced request.
+func exemplar(ctx context.Context) prometheus.Labels {
+	if id, ok := ctx.Value(traceKey{}).(string); ok {
+		return prometheus.Labels{"trace_id": id}
+	}
+	return nil
+}
+
+// newRequestID returns a random ID identifying a probe request in the logs.
+func newRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "unknown"
+	}
+	return hex.EncodeToString(b)
+}
+
+// labelPrefix prefixes the probe parameters adding labels to the metrics.
+const labelPrefix = "label_"
+
+// maxExtraLabels limits the number of labels added by probe parameters.
+const maxExtraLabels = 10
+
+// labelNameRegexp matches valid Prometheus label names.
+var labelNameRegexp = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+
+// reservedLabels are the label names used by the exporter's own metrics.
+var reservedLabels = map[string]bool{"protocol": true, "state": true, "stream": true, "version": true, "os": true, "title": true, "port": true, "direction": true, "target": true}
+
+// titleRegexp matches the run titles accepted as label values.
+var titleRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:-]{1,64}$`)
+
+// extraLabels returns the labels requested with label_<name>=<value> probe
+// parameters.
+func extraLabels(query url.Values) (map[string]string, error) {
+	labels := map[string]string{}
+	for param, values := range query {
+		if !strings.HasPrefix(param, labelPrefix) {
+			continue
+		}
+		name := strings.TrimPrefix(param, labelPrefix)
+		if !labelNameRegexp.MatchString(name) || strings.HasPrefix(name, "__") {
+			return nil, fmt.Errorf("'%s' parameter must have a valid label name after the %q prefix", param, labelPrefix)
+		}
+		if reservedLabels[name] {
+			return nil, fmt.Errorf("'%s' parameter uses the reserved label name %q", param, name)
+		}
+		if !utf8.ValidString(values[0]) {
+			return nil, fmt.Errorf("'%s' parameter must be valid UTF-8", param)
+		}
+		labels[name] = values[0]
+	}
+	if len(labels) > maxExtraLabels {
+		return nil, fmt.Errorf("at most %d '%s*' parameters may be specified, got %d", maxExtraLabels, labelPrefix, len(labels))
+	}
+	return labels, nil
+}
+
+// fitPeriod returns the test period leaving a margin of the probe timeout for
+// iperf3 to connect and report, in whole seconds as run by iperf3.
+func fitPeriod(timeout time.Duration) time.Duration {
+	period := (timeout * 9 / 10).Truncate(time.Second)
+	if period < time.Second {
+		return time.Second
+	}
+	return period
+}
+
+// minTimeout is the shortest probe timeout, which shorter scrape timeouts are
+// raised to, as no probe could complete within them.
+const minTimeout = 2 * time.Second
+
+// sizeRegexp matches the size notation accepted by iperf3, a number with an
+// optional K, M, G or T suffix.
+var sizeRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[KMGTkmgt]?$`)
+
+// bitrateRegexp matches the bitrate notation accepted by iperf3, a size with
+// an optional burst size in packets.
+var bitrateRegexp = regexp.MustCompile(`^[0-9]+(\.[0-9]+)?[KMGTkmgt]?(/[0-9]+)?$`)
+
+// extraArgRegexp matches the tokens accepted by --iperf3.extra-args, which
+// excludes whitespace, quotes and shell metacharacters.
+var extraArgRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.,:=/+-]+$`)
+
+// parseBitrate returns the bits per second of a bitrate in iperf3 notation,
+// whose suffixes are powers of 1000, or false if it isn't a valid bitrate.
+func parseBitrate(s string) (float64, bool) {
+	if !bitrateRegexp.MatchString(s) {
+		return 0, false
+	}
+	if i := strings.Index(s, "/"); i >= 0 {
+		s = s[:i]
+	}
+	multiplier := 1.0
+	switch s[len(s)-1] {
+	case 'K', 'k':
+		multiplier = 1e3
+	case 'M', 'm':
+		multiplier = 1e6
+	case 'G', 'g':
+		multiplier = 1e9
+	case 'T', 't':
+		multiplier = 1e12
+	}
+	if multiplier != 1 {
+		s = s[:len(s)-1]
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0, false
+	}
+	return v * multiplier, true
+}
+
+// parsePorts parses the comma-separated ports of the port parameter into a
+// sorted list, defaulting to the iperf3 port 5201, and reports all the invalid
+// ports at once.
+func parsePorts(s string) ([]int, error) {
+	if s == "" {
+		return []int{5201}, nil
+	}
+	var ports []int
+	var invalid []string
+	seen := map[int]bool{}
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		p, err := strconv.Atoi(v)
+		if err != nil || p < 1 || p > 65535 || seen[p] {
+			invalid = append(invalid, strconv.Quote(v))
+			continue
+		}
+		seen[p] = true
+		ports = append(ports, p)
+	}
+	if len(invalid) > 0 {
+		return nil, fmt.Errorf("'port' parameter must be a comma-separated list of distinct ports between 1 and 65535, got invalid ports %s", strings.Join(invalid, ", "))
+	}
+	sort.Ints(ports)
+	return ports, nil
+}
+
+// bindDevRegexp matches network interface names, which Linux limits to 15
+// characters.
+var bindDevRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.-]{1,15}$`)
+
+// congestionRegexp matches TCP congestion control algorithm names.
+var congestionRegexp = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// validSize reports whether s is a size iperf3 understands.
+func validSize(s string) bool {
+	return sizeRegexp.MatchString(s)
+}
+
+// limitRate rejects the requests exceeding the rate of limiter with 429 Too
+// Many Requests before they reach next.
+func limitRate(limiter *rate.Limiter, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !limiter.Allow() {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(1/float64(limiter.Limit())))))
+			http.Error(w, "Too many probe requests", http.StatusTooManyRequests)
+			iperfErrors.WithLabelValues("rejected").Inc()
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func handler(w http.ResponseWriter, r *http.Request) {
+	iperfInFlight.Inc()
+	defer iperfInFlight.Dec()
+
+	// Tag the logs of the request to correlate those of concurrent probes.
+	id := newRequestID()
+	logger := log.With("request_id", id)
+	ctx := context.WithValue(r.Context(), loggerKey{}, logger)
+	if trace, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+		ctx = context.WithValue(ctx, traceKey{}, trace)
+	}
+	r = r.WithContext(ctx)
+	w.Header().Set("X-Request-Id", id)
+	logger.Debugf("Probe request %q from %s", r.URL.RawQuery, r.RemoteAddr)
+
+	target := r.URL.Query().Get("target")
+	if target == "" {
+		http.Error(w, "'target' parameter must be specified", http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+	// The target is a label value of the exporter's own metrics.
+	if !utf8.ValidString(target) {
+		http.Error(w, "'target' parameter must be valid UTF-8", http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	// Accept host:port targets, as given by service discovery, unless the port
+	// is explicitly requested.
+	port := r.URL.Query().Get("port")
+	if host, hostPort, err := net.SplitHostPort(target); err == nil {
+		target = host
+		if port == "" {
+			port = hostPort
+		}
+	} else if strings.HasPrefix(target, "[") && strings.HasSuffix(target, "]") {
+		target = strings.Trim(target, "[]")
+	}
+
+	// Take the settings replaced by configuration reloads at once.
+	configMutex.RLock()
+	targets, defaults := allowlist, defaultsFor(target)
+	configMutex.RUnlock()
+
+	if !targets.allowed(r.Context(), target) {
+		http.Error(w, fmt.Sprintf("Target %q is not allowed", target), http.StatusForbidden)
+		iperfErrors.WithLabelValues("rejected").Inc()
+		return
+	}
+
+	format := r.URL.Query().Get("format")
+	if format != "" && format != "prometheus" && format != "json" {
+		http.Error(w, fmt.Sprintf("'format' parameter must be prometheus or json, got %q", format), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	labels, err := extraLabels(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	title := r.URL.Query().Get("title")
+	if title != "" && !titleRegexp.MatchString(title) {
+		http.Error(w, fmt.Sprintf("'title' parameter must be up to 64 letters, digits, '_', '.', ':' or '-', got %q", title), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	targetPorts, err := parsePorts(port)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+	// Results of several ports are only exported as metrics, which a port
+	// label tells apart.
+	if len(targetPorts) > 1 && format == "json" {
+		http.Error(w, "'format' parameter must be prometheus when several ports are given", http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	var runPeriod time.Duration
+	period := r.URL.Query().Get("period")
+	if period != "" {
+		var err error
+		runPeriod, err = time.ParseDuration(period)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'period' parameter must be a duration: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if runPeriod < 0 {
+			http.Error(w, fmt.Sprintf("'period' parameter must not be negative, got %s", period), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+	// A zero period asks for the default one, like no period at all.
+	explicitPeriod := runPeriod != 0
+	if !explicitPeriod {
+		runPeriod = defaults.Period
+	}
+
+	bytes := r.URL.Query().Get("bytes")
+	if bytes != "" && !validSize(bytes) {
+		http.Error(w, fmt.Sprintf("'bytes' parameter must be a size such as 100M or 1G, got %q", bytes), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	var blockCount int
+	if v := r.URL.Query().Get("blockcount"); v != "" {
+		var err error
+		blockCount, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'blockcount' parameter must be an integer: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if blockCount < 1 {
+			http.Error(w, fmt.Sprintf("'blockcount' parameter must be positive, got %d", blockCount), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	// The test ends after the period, the bytes or the blocks, only one of
+	// them may be requested.
+	var endConditions []string
+	if explicitPeriod {
+		endConditions = append(endConditions, "'period'")
+	}
+	if bytes != "" {
+		endConditions = append(endConditions, "'bytes'")
+	}
+	if blockCount > 0 {
+		endConditions = append(endConditions, "'blockcount'")
+	}
+	if len(endConditions) > 1 {
+		http.Error(w, fmt.Sprintf("Only one of the 'period', 'bytes' and 'blockcount' parameters may be specified, got %s", strings.Join(endConditions, " and ")), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	runConnectTimeout := *defaults.ConnectTimeout
+	if v := r.URL.Query().Get("connect_timeout"); v != "" {
+		var err error
+		runConnectTimeout, err = time.ParseDuration(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'connect_timeout' parameter must be a duration: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if runConnectTimeout < 0 {
+			http.Error(w, fmt.Sprintf("'connect_timeout' parameter must not be negative, got %s", v), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	var omitSeconds int
+	omit := r.URL.Query().Get("omit")
+	if omit != "" {
+		var err error
+		omitSeconds, err = strconv.Atoi(omit)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'omit' parameter must be an integer: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if omitSeconds < 0 {
+			http.Error(w, fmt.Sprintf("'omit' parameter must not be negative, got %d", omitSeconds), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	var parallelStreams int
+	parallel := r.URL.Query().Get("parallel")
+	if parallel != "" {
+		var err error
+		parallelStreams, err = strconv.Atoi(parallel)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'parallel' parameter must be an integer: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if parallelStreams < 1 || parallelStreams > 128 {
+			http.Error(w, "'parallel' parameter must be between 1 and 128", http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+	if parallelStreams == 0 {
+		parallelStreams = 1
+	}
+
+	var udpMode bool
+	if v := r.URL.Query().Get("udp_mode"); v != "" {
+		var err error
+		udpMode, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'udp_mode' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	var sctpMode bool
+	if v := r.URL.Query().Get("sctp"); v != "" {
+		var err error
+		sctpMode, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'sctp' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+	if udpMode && sctpMode {
+		http.Error(w, "'udp_mode' and 'sctp' parameters are mutually exclusive", http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	runRetries := *defaults.Retries
+	if v := r.URL.Query().Get("retries"); v != "" {
+		var err error
+		runRetries, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'retries' parameter must be an integer: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if runRetries < 0 {
+			http.Error(w, fmt.Sprintf("'retries' parameter must not be negative, got %d", runRetries), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	var bidir bool
+	if v := r.URL.Query().Get("bidir"); v != "" {
+		var err error
+		bidir, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'bidir' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	var reverse bool
+	if v := r.URL.Query().Get("reverse"); v != "" {
+		var err error
+		reverse, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'reverse' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+	if reverse && bidir {
+		http.Error(w, "'reverse' and 'bidir' parameters are mutually exclusive", http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	// Both directions are tested by running forward and then in reverse.
+	direction := r.URL.Query().Get("direction")
+	if direction != "" && direction != "forward" && direction != "reverse" && direction != "both" {
+		http.Error(w, fmt.Sprintf("'direction' parameter must be forward, reverse or both, got %q", direction), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+	if direction != "" && (reverse || bidir) {
+		http.Error(w, "'direction' parameter can't be combined with 'reverse' or 'bidir'", http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+	if direction == "reverse" {
+		reverse = true
+	}
+	if direction == "both" && format == "json" {
+		http.Error(w, "'format' parameter must be prometheus when both directions are tested", http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	var zeroCopy bool
+	if v := r.URL.Query().Get("zerocopy"); v != "" {
+		var err error
+		zeroCopy, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'zerocopy' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	bitrate := r.URL.Query().Get("bitrate")
+	if bitrate == "" {
+		bitrate = defaults.Bitrate
+	}
+	if bitrate != "" && !bitrateRegexp.MatchString(bitrate) {
+		http.Error(w, fmt.Sprintf("'bitrate' parameter must be a rate such as 100M or 1G, got %q", bitrate), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+	if udpMode && bitrate == "" {
+		logger.Infof("Probing %s in UDP mode without a bitrate, iperf3 defaults to 1 Mbit/s", target)
+	}
+
+	fqRate := r.URL.Query().Get("fq_rate")
+	if fqRate != "" && !bitrateRegexp.MatchString(fqRate) {
+		http.Error(w, fmt.Sprintf("'fq_rate' parameter must be a rate such as 100M or 1G, got %q", fqRate), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	var pacingTimer int
+	if v := r.URL.Query().Get("pacing_timer"); v != "" {
+		var err error
+		pacingTimer, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'pacing_timer' parameter must be an integer: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if pacingTimer <= 0 {
+			http.Error(w, fmt.Sprintf("'pacing_timer' parameter must be positive, got %d", pacingTimer), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	var perStream bool
+	if v := r.URL.Query().Get("per_stream"); v != "" {
+		var err error
+		perStream, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'per_stream' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+	// Keep the cardinality of the per-stream metrics bounded.
+	if perStream && parallelStreams > 16 {
+		http.Error(w, "'parallel' parameter must be at most 16 when 'per_stream' is set", http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	bind := r.URL.Query().Get("bind")
+	if bind != "" && net.ParseIP(bind) == nil {
+		if _, err := resolver.LookupHost(r.Context(), bind); err != nil {
+			http.Error(w, fmt.Sprintf("'bind' parameter must be an IP address or resolvable hostname: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	bindDev := r.URL.Query().Get("bind_dev")
+	if bindDev != "" && !bindDevRegexp.MatchString(bindDev) {
+		http.Error(w, fmt.Sprintf("'bind_dev' parameter must be a network interface name of up to 15 letters, digits, '_', '.' and '-', got %q", bindDev), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	var clientPort int
+	if v := r.URL.Query().Get("cport"); v != "" {
+		var err error
+		clientPort, err = strconv.Atoi(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'cport' parameter must be an integer: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if len(targetPorts) > 1 {
+			http.Error(w, "'cport' parameter can't be combined with several ports", http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		// Each parallel stream uses the port following the previous one.
+		if clientPort < 1 || clientPort+parallelStreams-1 > 65535 {
+			http.Error(w, fmt.Sprintf("'cport' parameter must be between 1 and %d with %d parallel streams, got %d", 65536-parallelStreams, parallelStreams, clientPort), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	ipVersion := r.URL.Query().Get("ip_version")
+	if ipVersion != "" && ipVersion != "4" && ipVersion != "6" {
+		http.Error(w, fmt.Sprintf("'ip_version' parameter must be 4 or 6, got %q", ipVersion), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	window := r.URL.Query().Get("window")
+	if window != "" && !validSize(window) {
+		http.Error(w, fmt.Sprintf("'window' parameter must be a size such as 256K or 1M, got %q", window), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	length := r.URL.Query().Get("length")
+	if length != "" && !validSize(length) {
+		http.Error(w, fmt.Sprintf("'length' parameter must be a size such as 1460 or 8K, got %q", length), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	congestion := r.URL.Query().Get("congestion")
+	if congestion != "" && !congestionRegexp.MatchString(congestion) {
+		http.Error(w, fmt.Sprintf("'congestion' parameter must be a congestion control algorithm name, got %q", congestion), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	var typeOfService int
+	if tos := r.URL.Query().Get("tos"); tos != "" {
+		v, err := strconv.ParseInt(tos, 0, 0)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'tos' parameter must be a decimal or 0x-prefixed hexadecimal integer: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if v < 0 || v > 255 {
+			http.Error(w, fmt.Sprintf("'tos' parameter must be between 0 and 255, got %d", v), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		typeOfService = int(v)
+	}
+
+	var segmentSize int
+	mss := r.URL.Query().Get("mss")
+	if mss != "" {
+		var err error
+		segmentSize, err = strconv.Atoi(mss)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'mss' parameter must be an integer: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if segmentSize < 88 || segmentSize > 9000 {
+			http.Error(w, fmt.Sprintf("'mss' parameter must be between 88 and 9000 bytes, got %d", segmentSize), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	var serverOutput bool
+	if v := r.URL.Query().Get("get_server_output"); v != "" {
+		var err error
+		serverOutput, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'get_server_output' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	var dryRun bool
+	if v := r.URL.Query().Get("dry_run"); v != "" {
+		var err error
+		dryRun, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'dry_run' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if dryRun && len(targetPorts) > 1 {
+			http.Error(w, "'dry_run' parameter can't be combined with several ports", http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		if dryRun && direction == "both" {
+			http.Error(w, "'dry_run' parameter can't be combined with both directions", http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	var strictTiming bool
+	if v := r.URL.Query().Get("strict_timing"); v != "" {
+		var err error
+		strictTiming, err = strconv.ParseBool(v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("'strict_timing' parameter must be a boolean: %s", err), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+
+	// If a timeout is configured via the Prometheus header, add it to the request.
+	var timeoutSeconds float64
+	if v := r.Header.Get("X-Prometheus-Scrape-Timeout-Seconds"); v != "" {
+		var err error
+		timeoutSeconds, err = strconv.ParseFloat(v, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("Failed to parse timeout from Prometheus header: %s", err), http.StatusInternalServerError)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+	}
+	// The configured iperf3 timeout is used when Prometheus didn't send one, and
+	// the maximum timeout, by default the same, limits the timeout Prometheus
+	// asked for.
+	limit := *timeout
+	if *maxTimeout > 0 {
+		limit = *maxTimeout
+	}
+	if timeoutSeconds > limit.Seconds() {
+		timeoutSeconds = limit.Seconds()
+	}
+	if timeoutSeconds == 0 {
+		timeoutSeconds = timeout.Seconds()
+	}
+
+	runTimeout := time.Duration(timeoutSeconds * float64(time.Second))
+	if runTimeout < minTimeout {
+		logger.Warnf("Scrape timeout of %s for %s is below the minimum probe timeout, using %s", runTimeout, target, minTimeout)
+		runTimeout = minTimeout
+	}
+
+	// Requested periods that cannot complete within the probe timeout, or half
+	// of it when both directions are tested, are rejected, while the default
+	// period is shortened to fit, unless timing is strict.
+	runBudget := runTimeout
+	if direction == "both" {
+		runBudget /= 2
+	}
+	if bytes == "" && blockCount == 0 && runPeriod >= runBudget {
+		if explicitPeriod || strictTiming {
+			http.Error(w, fmt.Sprintf("'period' parameter (%s) must be shorter than the probe timeout of each run (%s)", runPeriod, runBudget), http.StatusBadRequest)
+			iperfErrors.WithLabelValues("validation").Inc()
+			return
+		}
+		runPeriod = fitPeriod(runBudget)
+		logger.Debugf("Shortened the default period to %s to fit the probe timeout of %s", runPeriod, runBudget)
+	}
+
+	// The omitted seconds must leave part of the period, once fitted, to
+	// measure. Tests sending bytes or blocks have no period to compare with.
+	if bytes == "" && blockCount == 0 && time.Duration(omitSeconds)*time.Second >= runPeriod {
+		http.Error(w, fmt.Sprintf("'omit' parameter must be less than the test period (%s), got %d", runPeriod, omitSeconds), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	start := time.Now()
+	registry := prometheus.NewRegistry()
+	config := probeConfig{
+		target:         target,
+		port:           targetPorts[0],
+		period:         runPeriod,
+		timeout:        runTimeout,
+		parallel:       parallelStreams,
+		bind:           bind,
+		bindDev:        bindDev,
+		clientPort:     clientPort,
+		window:         window,
+		mss:            segmentSize,
+		length:         length,
+		omit:           omitSeconds,
+		ipVersion:      ipVersion,
+		congestion:     congestion,
+		tos:            typeOfService,
+		serverOutput:   serverOutput,
+		connectTimeout: runConnectTimeout,
+		perStream:      perStream,
+		udp:            udpMode,
+		sctp:           sctpMode,
+		bidir:          bidir,
+		reverse:        reverse,
+		zeroCopy:       zeroCopy,
+		retries:        runRetries,
+		bitrate:        bitrate,
+		fqRate:         fqRate,
+		pacingTimer:    pacingTimer,
+		bytes:          bytes,
+		blockCount:     blockCount,
+		title:          title,
+		username:       *authUsername,
+		rsaPublicKey:   *authPublicKey,
+	}
+	args, err := buildArgs(config)
+	if err == nil && direction == "both" {
+		reverseConfig := config
+		reverseConfig.reverse = true
+		_, err = buildArgs(reverseConfig)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		iperfErrors.WithLabelValues("validation").Inc()
+		return
+	}
+
+	// Show the iperf command the probe would run instead of running it.
+	if dryRun {
+		w.Header().Set("Content-Type", "application/json")
+		command := struct {
+			Command string   `json:"command"`
+			Args    []string `json:"args"`
+		}{client.Command(), args}
+		if err := json.NewEncoder(w).Encode(command); err != nil {
+			logger.Warnf("Failed to write to HTTP client: %s", err)
+		}
+		return
+	}
+
+	// Wait for other probes of the same target and ports to finish, within the
+	// probe timeout or --web.probe-queue-timeout, and leave the remainder of
+	// the timeout for this probe. The ports are locked in ascending order so
+	// probes of overlapping ports can't deadlock.
+	ctx, cancel := context.WithTimeout(r.Context(), runTimeout)
+	defer cancel()
+	defer inFlightProbes.add(cancel)()
+	waitStart := time.Now()
+	waitCtx, cancelWait := ctx, func() {}
+	if *perTargetWait > 0 {
+		waitCtx, cancelWait = context.WithTimeout(ctx, *perTargetWait)
+	}
+	defer cancelWait()
+	for _, p := range targetPorts {
+		release, err := probeLocks.acquire(waitCtx, net.JoinHostPort(target, strconv.Itoa(p)))
+		if err == errQueueFull {
+			w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(runPeriod.Seconds()))))
+			http.Error(w, fmt.Sprintf("Too many probes waiting for the target: %d queued", *perTargetQueue), http.StatusTooManyRequests)
+			iperfErrors.WithLabelValues("rejected").Inc()
+			return
+		}
+		if err != nil {
+			if ctx.Err() == context.Canceled {
+				iperfCancels.Inc()
+			}
+			http.Error(w, fmt.Sprintf("Timed out waiting for another probe of the target: %s", err), http.StatusServiceUnavailable)
+			iperfErrors.WithLabelValues("rejected").Inc()
+			return
+		}
+		defer release()
+	}
+	config.timeout -= time.Since(waitStart)
+
+	// Each port runs its own iperf, taking a probe slot.
+	if probeSlots != nil {
+		for range targetPorts {
+			select {
+			case probeSlots <- struct{}{}:
+				defer func() { <-probeSlots }()
+			default:
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(runPeriod.Seconds()))))
+				http.Error(w, "Too many probes in flight", http.StatusTooManyRequests)
+				iperfErrors.WithLabelValues("rejected").Inc()
+				return
+			}
+		}
+	}
+
+	if format == "json" {
+		stats, ok := cache.get(config)
+		if !ok {
+			var err error
+			stats, _, err = NewExporter(ctx, config, labels).probe()
+			if err != nil {
+				http.Error(w, fmt.Sprintf("Probe failed: %s", err), http.StatusBadGateway)
+				return
+			}
+			cache.set(config, stats)
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if err := json.NewEncoder(w).Encode(stats); err != nil {
+			logger.Warnf("Failed to write to HTTP client: %s", err)
+		}
+	} else {
+		// Probe several ports with a collector each, labelled by port, which
+		// the registry collects concurrently.
+		for _, p := range targetPorts {
+			portConfig, portLabels := config, labels
+			if len(targetPorts) > 1 {
+				portConfig.port = p
+				portLabels = map[string]string{"port": strconv.Itoa(p)}
+				for name, value := range labels {
+					portLabels[name] = value
+				}
+			}
+			var collector prometheus.Collector
+			if direction == "both" {
+				collector = bothDirections(ctx, portConfig, portLabels)
+			} else {
+				collector = NewExporter(ctx, portConfig, portLabels)
+			}
+			if err := registry.Register(collector); err != nil {
+				http.Error(w, fmt.Sprintf("Invalid probe metrics: %s", err), http.StatusBadRequest)
+				iperfErrors.WithLabelValues("validation").Inc()
+				return
+			}
+		}
+
+		// Delegate http serving to Prometheus client library, which will call collector.Collect
+		// and serve OpenMetrics to the scrapers asking for it.
+		h := promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true})
+		h.ServeHTTP(w, r)
+	}
+
+	duration := time.Since(start).Seconds()
+	iperfDuration.WithLabelValues(target, config.protocol()).(prometheus.ExemplarObserver).ObserveWithExemplar(duration, exemplar(r.Context()))
+}
+
+// newMux returns the handler of all the endpoints, served under
+// --web.route-prefix.
+func newMux() *http.ServeMux {
+	mux := http.NewServeMux()
+
+	// Serve the endpoints without the trailing slash of the prefix.
+	prefix := strings.TrimRight(*routePrefix, "/")
+	if prefix != "" && !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+
+	// Exemplars are only exposed in the OpenMetrics format.
+	mux.Handle(prefix+*metricsPath, promhttp.InstrumentMetricHandler(prometheus.DefaultRegisterer, promhttp.HandlerFor(prometheus.DefaultGatherer, promhttp.HandlerOpts{EnableOpenMetrics: true})))
+	if *rateLimit > 0 {
+		mux.Handle(prefix+"/probe", limitRate(rate.NewLimiter(rate.Limit(*rateLimit), int(math.Ceil(*rateLimit))), http.HandlerFunc(handler)))
+	} else {
+		mux.HandleFunc(prefix+"/probe", handler)
+	}
+	mux.HandleFunc(prefix+"/health", healthHandler)
+	mux.HandleFunc(prefix+"/ready", readyHandler)
+	// The profiling endpoints registered by net/http/pprof.
+	mux.Handle("/debug/pprof/", http.DefaultServeMux)
+
+	if prefix != "" {
+		mux.Handle(prefix, http.RedirectHandler(prefix+"/", http.StatusFound))
+	}
+	mux.HandleFunc(prefix+"/", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		_, err := w.Write([]byte(`<html>
+    <head><title>iPerf3 Exporter</title></head>
+    <body>
+    <h1>iPerf3 Exporter</h1>
+    <p><a href="` + prefix + `/probe?target=prometheus.io">Probe prometheus.io</a></p>
+    <p><a href='` + prefix + *metricsPath + `'>Metrics</a></p>
+    <p>Command-line flags can also be set from environment variables named after them, e.g. <code>IPERF3_TIMEOUT</code> for <code>--iperf3.timeout</code>.</p>
+    </html>`))
+		if err != nil {
+			log.Warnf("Failed to write to HTTP client: %s", err)
+		}
+	})
+	return mux
+}
+
+func main() {
+	log.AddFlags(kingpin.CommandLine)
+	kingpin.Version(version.Print("iperf3_exporter"))
+	kingpin.HelpFlag.Short('h')
+	setEnvars(kingpin.CommandLine)
+	if kingpin.Parse() == checkConfigCommand.FullCommand() {
+		if err := checkConfig(); err != nil {
+			kingpin.Fatalf("invalid configuration: %s", err)
+		}
+		fmt.Println("Configuration is valid")
+		return
+	}
+
+	if *logFile != "" {
+		// The logger can only be pointed at the file in place of standard
+		// error, so other log targets can't be combined with it.
+		format := kingpin.CommandLine.GetFlag("log.format").Model().Value.String()
+		if u, err := url.Parse(format); err != nil || u.Opaque != "stderr" {
+			log.Fatalf("--log.file can only be combined with a --log.format logging to stderr, got %q", format)
+		}
+		if err := logToFile(*logFile, format); err != nil {
+			log.Warnf("Failed to open log file, logging to standard error: %s", err)
+		}
+	}
+
+	flagSettings = currentSettings()
+	if *configFile != "" {
+		if err := loadConfig(*configFile, os.Args[1:], false); err != nil {
+			log.Fatalf("Failed to load configuration file: %s", err)
+		}
+	}
+
+	log.Info("Starting iperf3 exporter", version.Info())
+	log.Info("Build context", version.BuildContext())
+
+	if *binary == "iperf" {
+		client = iperf2Client{}
+	}
+	cache = newResultCache(*cacheTTL)
+	probeLocks = newTargetLocks(*perTargetLimit, *perTargetQueue)
+
+	if v, err := iperfVersion(context.Background()); err != nil {
+		log.Warnf("Failed to get iperf version: %s", err)
+	} else {
+		log.Infof("Using %s version %s", client.Command(), v)
+		versionInfo := prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        prometheus.BuildFQName(namespace, "", "version_info"),
+			Help:        "Version of the iperf client used by the exporter.",
+			ConstLabels: prometheus.Labels{"version": v},
+		})
+		versionInfo.Set(1)
+		prometheus.MustRegister(versionInfo)
+	}
+
+	if err := validateConfig(); err != nil {
+		log.Fatalf("Invalid configuration: %s", err)
+	}
+
+	if *selfTest {
+		if err := runSelfTest(); err != nil {
+			if *selfTestFatal {
+				log.Fatalf("Self-test against %s failed: %s", selfTestConfig.target, err)
+			}
+			log.Errorf("Self-test against %s failed: %s", selfTestConfig.target, err)
+		} else {
+			log.Infof("Self-test against %s succeeded", selfTestConfig.target)
+		}
+	}
+
+	var err error
+	allowlist, err = parseAllowlist(*targetAllowlistFlag)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *maxConcurrent > 0 {
+		probeSlots = make(chan struct{}, *maxConcurrent)
+	}
+
+	prometheus.MustRegister(version.NewCollector("iperf3_exporter"))
+	prometheus.MustRegister(iperfDuration)
+	prometheus.MustRegister(iperfInFlight)
+	prometheus.MustRegister(iperfErrors)
+	prometheus.MustRegister(iperfCancels)
+	prometheus.MustRegister(iperfRetries)
+	prometheus.MustRegister(sentBytesTotal)
+	prometheus.MustRegister(receivedBytesTotal)
+	for _, reason := range errorReasons {
+		iperfErrors.WithLabelValues(reason)
+	}
+	prometheus.MustRegister(configuredTimeout)
+	prometheus.MustRegister(defaultPeriodGauge)
+	prometheus.MustRegister(maxConcurrentGauge)
+	prometheus.MustRegister(cacheEntries)
+	prometheus.MustRegister(cacheMisses)
+	prometheus.MustRegister(cacheEvictions)
+
+	configuredTimeout.Set(timeout.Seconds())
+	defaultPeriodGauge.Set(defaultPeriod.Seconds())
+	maxConcurrentGauge.Set(float64(*maxConcurrent))
+
+	// Leave the longest probes time to write their results.
+	writeTimeout := 60 * time.Second
+	if longest := *timeout + 10*time.Second; longest > writeTimeout {
+		writeTimeout = longest
+	}
+	if longest := *maxTimeout + 10*time.Second; longest > writeTimeout {
+		writeTimeout = longest
+	}
+
+	srv := &http.Server{
+		Addr:         *listenAddress,
+		Handler:      newMux(),
+		ReadTimeout:  60 * time.Second,
+		WriteTimeout: writeTimeout,
+	}
+
+	listener, err := listen()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	go func() {
+		log.Infof("Listening on %s", listener.Addr())
+		if err := srv.Serve(listener); err != http.ErrServerClosed {
+			log.Fatal(err)
+		}
+	}()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			if *configFile == "" {
+				log.Warn("Ignoring SIGHUP, no configuration file to reload")
+				continue
+			}
+			if err := reloadConfig(); err != nil {
+				log.Errorf("Failed to reload configuration file, keeping the previous configuration: %s", err)
+				continue
+			}
+			log.Infof("Reloaded configuration file %s", *configFile)
+		}
+	}()
+
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, os.Interrupt, syscall.SIGTERM)
+	<-term
+
+	log.Info("Shutting down iperf3 exporter")
+	stop(srv)
+}
+
+// versionRegexp matches the version number in the output of iperf --version.
+var versionRegexp = regexp.MustCompile(`[0-9]+\.[0-9]+(\.[0-9]+)*`)
+
+// iperfVersion returns the version of the installed iperf client.
+func iperfVersion(ctx context.Context) (string, error) {
+	out, err := exec.CommandContext(ctx, client.Command(), "--version").CombinedOutput()
+	if err != nil {
+		return "", fmt.Errorf("%s: %s", err, strings.TrimSpace(string(out)))
+	}
+	v := versionRegexp.FindString(string(out))
+	if v == "" {
+		return "", fmt.Errorf("no version in %q", strings.TrimSpace(string(out)))
+	}
+	return v, nil
+}
+
+// cancelGrace is how long cancelled probes have to respond before their
+// connections are closed on shutdown.
+const cancelGrace = 5 * time.Second
+
+// logToFile redirects the logs written to standard error to the end of the
+// file, keeping the --log.format options such as json.
+func logToFile(name, format string) error {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	os.Stderr = f
+	// Registered first, the file is closed last on shutdown.
+	closers = append(closers, f)
+	return log.Base().SetFormat(format)
+}
+
+// listen returns the listener the HTTP server is served on, either inherited
+// from systemd or bound to --web.listen-address.
+func listen() (net.Listener, error) {
+	if *systemdSocket {
+		return systemdListener()
+	}
+	return net.Listen("tcp", *listenAddress)
+}
+
+// stop gracefully shuts down the HTTP server, giving in-flight probes up to
+// --web.shutdown-grace-period to complete, and then closes the registered
+// closers. Probes still running after the grace period are cancelled, and
+// given a moment to report their failure before the connections are closed.
+func stop(srv *http.Server) {
+	ctx, cancel := context.WithTimeout(context.Background(), *shutdownGrace)
+	defer cancel()
+
+	if err := srv.Shutdown(ctx); err == context.DeadlineExceeded {
+		log.Warnf("Cancelled %d probes still running after %s", inFlightProbes.cancelAll(), *shutdownGrace)
+		ctx, cancel := context.WithTimeout(context.Background(), cancelGrace)
+		defer cancel()
+		if err := srv.Shutdown(ctx); err != nil {
+			log.Errorf("Failed to shut down HTTP server: %s", err)
+			srv.Close()
+		}
+	} else if err != nil {
+		log.Errorf("Failed to shut down HTTP server: %s", err)
+	}
+
+	for i := len(closers) - 1; i >= 0; i-- {
+		if err := closers[i].Close(); err != nil {
+			log.Errorf("Failed to close resource: %s", err)
+		}
+	}
 }
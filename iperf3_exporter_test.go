@@ -0,0 +1,1946 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/common/log"
+	"gopkg.in/alecthomas/kingpin.v2"
+)
+
+func TestMain(m *testing.M) {
+	// Set the flags to their defaults.
+	if _, err := kingpin.CommandLine.Parse(nil); err != nil {
+		panic(err)
+	}
+	os.Exit(m.Run())
+}
+
+// bufferedCloser is a buffered writer flushed on Close, recording the order
+// it was closed in.
+type bufferedCloser struct {
+	*bufio.Writer
+	name   string
+	closed *[]string
+}
+
+func (c bufferedCloser) Close() error {
+	*c.closed = append(*c.closed, c.name)
+	return c.Flush()
+}
+
+func TestStopClosesResources(t *testing.T) {
+	defer func(saved []io.Closer) { closers = saved }(closers)
+
+	var out bytes.Buffer
+	var closed []string
+	first := bufferedCloser{bufio.NewWriter(&out), "first", &closed}
+	second := bufferedCloser{bufio.NewWriter(&bytes.Buffer{}), "second", &closed}
+	closers = []io.Closer{first, second}
+
+	if _, err := first.WriteString("audit record\n"); err != nil {
+		t.Fatal(err)
+	}
+	if out.Len() != 0 {
+		t.Fatalf("record written before shutdown: %q", out.String())
+	}
+
+	stop(&http.Server{})
+
+	if out.String() != "audit record\n" {
+		t.Errorf("record not flushed on shutdown, got %q", out.String())
+	}
+	if len(closed) != 2 || closed[0] != "second" || closed[1] != "first" {
+		t.Errorf("closers closed in order %v, want [second first]", closed)
+	}
+}
+
+func TestIperf3Args(t *testing.T) {
+	base := probeConfig{target: "iperf.example.com", port: 5201, period: 5 * time.Second, parallel: 1}
+	tests := []struct {
+		name   string
+		config func(c *probeConfig)
+		want   []string
+	}{
+		{"tcp", func(c *probeConfig) {}, []string{"-t", "5"}},
+		{"udp", func(c *probeConfig) { c.udp = true }, []string{"-t", "5", "-u"}},
+		{"reverse", func(c *probeConfig) { c.reverse = true }, []string{"-t", "5", "-R"}},
+		{"bitrate", func(c *probeConfig) { c.udp, c.bitrate = true, "100M" }, []string{"-t", "5", "-u", "-b", "100M"}},
+		{"bytes", func(c *probeConfig) { c.bytes = "10M" }, []string{"-n", "10M"}},
+		{"blockcount", func(c *probeConfig) { c.blockCount = 100 }, []string{"-k", "100"}},
+		{"connect timeout", func(c *probeConfig) { c.connectTimeout = 1500 * time.Millisecond }, []string{"-t", "5", "--connect-timeout", "1500"}},
+		{"connect timeout below a second", func(c *probeConfig) { c.connectTimeout = 250 * time.Millisecond }, []string{"-t", "5", "--connect-timeout", "250"}},
+		{"parallel", func(c *probeConfig) { c.parallel = 4 }, []string{"-t", "5"}},
+		{"auth", func(c *probeConfig) { c.username, c.rsaPublicKey = "probe", "/etc/iperf3/public.pem" }, []string{"-t", "5", "--username", "probe", "--rsa-public-key-path", "/etc/iperf3/public.pem"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			c := base
+			test.config(&c)
+			got, err := iperf3Client{}.Args(c)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want := append([]string{"-J", "-i", "1", "-c", "iperf.example.com", "-p", "5201", "-P", strconv.Itoa(c.parallel)}, test.want...)
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("got %q, want %q", got, want)
+			}
+		})
+	}
+}
+
+func TestBuildArgsAppendsExtraArgs(t *testing.T) {
+	defer func(saved []string) { *extraArgs = saved }(*extraArgs)
+	*extraArgs = []string{"--dont-fragment"}
+
+	args, err := buildArgs(probeConfig{target: "iperf.example.com", port: 5201, period: time.Second, parallel: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if last := args[len(args)-1]; last != "--dont-fragment" {
+		t.Errorf("last argument is %q, want the extra argument", last)
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	for msg, want := range map[string]bool{
+		"exit status 1: error - unable to connect to server: Connection refused":                                                true,
+		"exit status 1: error - unable to receive results: Connection reset by peer":                                            true,
+		"exit status 1: error - unable to connect to server: No route to host":                                                  true,
+		"exit status 1: error - unable to connect to server: Name or service not known":                                         false,
+		"exit status 1: error - unable to set TCP_CONGESTION: Supplied congestion control algorithm not supported on this host": false,
+		"signal: killed": false,
+	} {
+		if got := retryable(msg); got != want {
+			t.Errorf("retryable(%q) = %v, want %v", msg, got, want)
+		}
+	}
+}
+
+func TestWait(t *testing.T) {
+	e := &Exporter{config: probeConfig{period: time.Second}}
+
+	// A retry that can't complete within the deadline isn't waited for.
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if e.wait(ctx, time.Second) {
+		t.Error("waited for a retry past the deadline")
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("waited before giving up on a retry past the deadline")
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	if !e.wait(ctx, 10*time.Millisecond) {
+		t.Error("didn't wait for a retry within the deadline")
+	}
+
+	cancel()
+	if e.wait(ctx, 10*time.Millisecond) {
+		t.Error("waited for a retry of a cancelled probe")
+	}
+}
+
+// fakeResult is the report of a successful run of the fake iperf3.
+const fakeResult = `{"end":{"sum_sent":{"seconds":1,"bytes":1000},"sum_received":{"seconds":1,"bytes":900}}}`
+
+// fakeIperf3 installs an iperf3 script failing with a refused connection the
+// given number of times before succeeding, and returns a function restoring
+// the path.
+func fakeIperf3(t *testing.T, failures int) func() {
+	return fakeIperf3Script(t, `n=$(cat "$0.count" 2>/dev/null || echo 0)
+n=$((n+1))
+echo $n > "$0.count"
+if [ $n -le `+strconv.Itoa(failures)+` ]; then
+	echo '{"error":"unable to connect to server: Connection refused"}'
+	exit 1
+fi
+echo '`+fakeResult+`'
+`)
+}
+
+// fakeIperf3Script installs an iperf3 shell script with the body, and returns
+// a function restoring the path.
+func fakeIperf3Script(t *testing.T, body string) func() {
+	if runtime.GOOS == "windows" {
+		t.Skip("the fake iperf3 is a shell script")
+	}
+	dir, err := ioutil.TempDir("", "iperf3_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(dir, iperfCmd), []byte("#!/bin/sh\n"+body), 0755); err != nil {
+		t.Fatal(err)
+	}
+	path := os.Getenv("PATH")
+	os.Setenv("PATH", dir+string(os.PathListSeparator)+path)
+	return func() {
+		os.Setenv("PATH", path)
+		os.RemoveAll(dir)
+	}
+}
+
+func TestProbeRetries(t *testing.T) {
+	tests := []struct {
+		name     string
+		retries  int
+		attempts int
+		success  bool
+	}{
+		{"succeeds after retries", 2, 3, true},
+		{"fails once out of retries", 1, 2, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			defer fakeIperf3(t, 2)()
+
+			target := "retry-" + strconv.Itoa(test.retries) + ".example.com"
+			config := probeConfig{target: target, port: 5201, timeout: 10 * time.Second, parallel: 1, retries: test.retries}
+			before := testutil.ToFloat64(iperfRetries.WithLabelValues(target))
+			stats, attempts, err := NewExporter(context.Background(), config, nil).probe()
+			if (err == nil) != test.success {
+				t.Fatalf("got error %v, want success %v", err, test.success)
+			}
+			if attempts != test.attempts {
+				t.Errorf("got %d attempts, want %d", attempts, test.attempts)
+			}
+			if retries := testutil.ToFloat64(iperfRetries.WithLabelValues(target)) - before; retries != float64(test.attempts-1) {
+				t.Errorf("counted %v retries, want %d", retries, test.attempts-1)
+			}
+			if test.success && stats.End.SumSent.Bytes != 1000 {
+				t.Errorf("got %v bytes sent, want 1000", stats.End.SumSent.Bytes)
+			}
+		})
+	}
+}
+
+func TestServerBusy(t *testing.T) {
+	msg := "exit status 1: error - the server is busy running a test. try again later"
+	if !retryable(msg) {
+		t.Error("busy server error isn't retryable")
+	}
+	if reason := runErrorReason(context.Background(), msg); reason != "server_busy" {
+		t.Errorf("busy server error reason is %q, want server_busy", reason)
+	}
+}
+
+func TestRunErrorReason(t *testing.T) {
+	for msg, want := range map[string]string{
+		"exit status 1: error - unable to connect to server: Connection refused":        "connection_refused",
+		"exit status 1: error - unable to connect to server: Name or service not known": "dns",
+		"exit status 1: error - control socket has closed unexpectedly":                 "run",
+	} {
+		if got := runErrorReason(context.Background(), msg); got != want {
+			t.Errorf("runErrorReason(%q) = %q, want %q", msg, got, want)
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 0)
+	defer cancel()
+	<-ctx.Done()
+	if got := runErrorReason(ctx, "signal: killed"); got != "timeout" {
+		t.Errorf("runErrorReason of a timed out run = %q, want timeout", got)
+	}
+}
+
+func TestParsePorts(t *testing.T) {
+	for s, want := range map[string][]int{
+		"":                {5201},
+		"5201":            {5201},
+		"5203, 5201,5202": {5201, 5202, 5203},
+		"1,65535":         {1, 65535},
+	} {
+		got, err := parsePorts(s)
+		if err != nil {
+			t.Errorf("parsePorts(%q): %s", s, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("parsePorts(%q) = %v, want %v", s, got, want)
+		}
+	}
+
+	_, err := parsePorts("5201,0,http,5201,65536")
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	// All the invalid ports are reported at once.
+	for _, port := range []string{`"0"`, `"http"`, `"5201"`, `"65536"`} {
+		if !strings.Contains(err.Error(), port) {
+			t.Errorf("error %q doesn't list the invalid port %s", err, port)
+		}
+	}
+}
+
+func TestExtraLabels(t *testing.T) {
+	labels, err := extraLabels(url.Values{"target": {"iperf.example.com"}, "label_site": {"ams1"}, "label_rack": {"r2", "r3"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"site": "ams1", "rack": "r2"}; !reflect.DeepEqual(labels, want) {
+		t.Errorf("got labels %v, want %v", labels, want)
+	}
+
+	tooMany := url.Values{}
+	for i := 0; i <= maxExtraLabels; i++ {
+		tooMany.Set("label_l"+strconv.Itoa(i), "v")
+	}
+	for name, query := range map[string]url.Values{
+		"reserved":      {"label_protocol": {"tcp"}},
+		"invalid name":  {"label_1site": {"ams1"}},
+		"empty name":    {"label_": {"ams1"}},
+		"internal name": {"label___name__": {"up"}},
+		"invalid UTF-8": {"label_site": {"ams\xff"}},
+		"too many":      tooMany,
+	} {
+		if _, err := extraLabels(query); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestProbeDurationMetric(t *testing.T) {
+	defer fakeIperf3(t, 0)()
+
+	config := probeConfig{target: "127.0.0.1", port: 5202, timeout: 10 * time.Second, parallel: 1}
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewExporter(context.Background(), config, nil))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != "iperf3_probe_duration_seconds" {
+			continue
+		}
+		metric := family.GetMetric()[0]
+		labels := map[string]string{}
+		for _, label := range metric.GetLabel() {
+			labels[label.GetName()] = label.GetValue()
+		}
+		if labels["target"] != "127.0.0.1" || labels["port"] != "5202" {
+			t.Errorf("got labels %v, want the target and port", labels)
+		}
+		if value := metric.GetGauge().GetValue(); value < 0 {
+			t.Errorf("got negative run duration %v", value)
+		}
+		return
+	}
+	t.Error("iperf3_probe_duration_seconds not exported")
+}
+
+func TestParseTraceparent(t *testing.T) {
+	for header, want := range map[string]string{
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":        "4bf92f3577b34da6a3ce929d0e0e4736",
+		"01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future": "4bf92f3577b34da6a3ce929d0e0e4736",
+		"": "",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-future": "",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01":        "",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01":        "",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01":        "",
+		"00-4BF92F3577B34DA6A3CE929D0E0E4736-00f067aa0ba902b7-01":        "",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7":           "",
+	} {
+		got, ok := parseTraceparent(header)
+		if got != want || ok != (want != "") {
+			t.Errorf("parseTraceparent(%q) = %q, %v, want %q", header, got, ok, want)
+		}
+	}
+}
+
+func TestProbeExemplars(t *testing.T) {
+	defer fakeIperf3(t, 0)()
+
+	trace := "4bf92f3577b34da6a3ce929d0e0e4736"
+	ctx := context.WithValue(context.Background(), traceKey{}, trace)
+	config := probeConfig{target: "exemplar.example.com", port: 5201, timeout: 10 * time.Second, parallel: 1}
+	if _, _, err := NewExporter(ctx, config, nil).probe(); err != nil {
+		t.Fatal(err)
+	}
+
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(sentBytesTotal)
+	req := httptest.NewRequest("GET", "/metrics", nil)
+	req.Header.Set("Accept", "application/openmetrics-text; version=0.0.1")
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(registry, promhttp.HandlerOpts{EnableOpenMetrics: true}).ServeHTTP(rec, req)
+
+	// The exemplar holds the bytes of the traced run, whatever the total.
+	want := regexp.MustCompile(`(?m)^iperf3_sent_bytes_total\{protocol="tcp",target="exemplar.example.com"\} \S+ # \{trace_id="` + trace + `"\} 1000.0 `)
+	if !want.MatchString(rec.Body.String()) {
+		t.Errorf("OpenMetrics output doesn't link the traffic to the trace, want %s in:\n%s", want, rec.Body.String())
+	}
+}
+
+func TestProbeContentNegotiation(t *testing.T) {
+	defer fakeIperf3(t, 0)()
+
+	tests := []struct {
+		accept      string
+		contentType string
+		openMetrics bool
+	}{
+		{"application/openmetrics-text; version=0.0.1", "application/openmetrics-text; version=0.0.1; charset=utf-8", true},
+		{"text/plain", "text/plain; version=0.0.4; charset=utf-8", false},
+		{"", "text/plain; version=0.0.4; charset=utf-8", false},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/probe?target=127.0.0.1", nil)
+		if test.accept != "" {
+			req.Header.Set("Accept", test.accept)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("Accept %q: got status %d: %s", test.accept, rec.Code, rec.Body.String())
+		}
+		if got := rec.Header().Get("Content-Type"); got != test.contentType {
+			t.Errorf("Accept %q: got content type %q, want %q", test.accept, got, test.contentType)
+		}
+		// OpenMetrics expositions end with an EOF marker.
+		if got := strings.HasSuffix(rec.Body.String(), "# EOF\n"); got != test.openMetrics {
+			t.Errorf("Accept %q: got OpenMetrics body %v, want %v", test.accept, got, test.openMetrics)
+		}
+	}
+}
+
+// probeRequest serves a probe request with the query and returns the
+// response.
+func probeRequest(query string) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest("GET", "/probe?"+query, nil))
+	return rec
+}
+
+func TestConnectTimeoutParameter(t *testing.T) {
+	defer fakeIperf3(t, 0)()
+
+	for value, code := range map[string]int{
+		"5s":   http.StatusOK,
+		"0s":   http.StatusOK,
+		"-1s":  http.StatusBadRequest,
+		"soon": http.StatusBadRequest,
+	} {
+		validation := testutil.ToFloat64(iperfErrors.WithLabelValues("validation"))
+		rec := probeRequest("target=127.0.0.1&connect_timeout=" + value)
+		if rec.Code != code {
+			t.Errorf("connect_timeout=%s: got status %d, want %d: %s", value, rec.Code, code, rec.Body.String())
+		}
+		want := 0.0
+		if code == http.StatusBadRequest {
+			want = 1
+		}
+		if counted := testutil.ToFloat64(iperfErrors.WithLabelValues("validation")) - validation; counted != want {
+			t.Errorf("connect_timeout=%s: counted %v validation errors, want %v", value, counted, want)
+		}
+	}
+}
+
+func TestConnectTimeoutDefault(t *testing.T) {
+	// Older iperf3 builds reject --connect-timeout, so it is only passed
+	// when configured.
+	if *connectTimeout != 0 {
+		t.Fatalf("default connect timeout is %s, want none", *connectTimeout)
+	}
+	args, err := buildArgs(probeConfig{target: "iperf.example.com", port: 5201, period: time.Second, parallel: 1, connectTimeout: *defaultsFor("iperf.example.com").ConnectTimeout})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, arg := range args {
+		if arg == "--connect-timeout" {
+			t.Errorf("default arguments %q have a connect timeout", args)
+		}
+	}
+}
+
+func TestMaxConcurrentProbes(t *testing.T) {
+	defer fakeIperf3Script(t, "sleep 1\necho '"+fakeResult+"'\n")()
+	defer func(saved int) { *maxConcurrent = saved }(*maxConcurrent)
+	defer func() { probeSlots = nil }()
+	*maxConcurrent = 2
+	probeSlots = make(chan struct{}, *maxConcurrent)
+
+	// Probe different targets, which don't wait for each other.
+	codes := make(chan int, *maxConcurrent)
+	for i := 1; i <= *maxConcurrent; i++ {
+		target := "127.0.0." + strconv.Itoa(i)
+		go func() { codes <- probeRequest("target=" + target + "&period=1s").Code }()
+	}
+	for len(probeSlots) < *maxConcurrent {
+		time.Sleep(time.Millisecond)
+	}
+
+	rec := probeRequest("target=127.0.0.10&period=1s")
+	if rec.Code != http.StatusTooManyRequests {
+		t.Errorf("probe past the limit got status %d, want %d", rec.Code, http.StatusTooManyRequests)
+	}
+	if retry := rec.Header().Get("Retry-After"); retry != "1" {
+		t.Errorf("got Retry-After %q, want the test period of 1 second", retry)
+	}
+	for i := 0; i < *maxConcurrent; i++ {
+		if code := <-codes; code != http.StatusOK {
+			t.Errorf("probe within the limit got status %d", code)
+		}
+	}
+}
+
+// slowIperf3 is a fake iperf3 run outlasting the tests, which exec lets the
+// probe context kill.
+const slowIperf3 = "exec sleep 30\n"
+
+// waitInFlight waits until a probe is in flight.
+func waitInFlight(t *testing.T) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		inFlightProbes.mutex.Lock()
+		n := len(inFlightProbes.cancels)
+		inFlightProbes.mutex.Unlock()
+		if n > 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("probe didn't start")
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestStopCancelsProbes(t *testing.T) {
+	defer fakeIperf3Script(t, slowIperf3)()
+	defer func(saved time.Duration) { *shutdownGrace = saved }(*shutdownGrace)
+	*shutdownGrace = 100 * time.Millisecond
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(handler)}
+	go srv.Serve(ln)
+
+	body := make(chan string, 1)
+	go func() {
+		resp, err := http.Get("http://" + ln.Addr().String() + "/probe?target=127.0.0.1")
+		if err != nil {
+			body <- err.Error()
+			return
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		body <- string(b)
+	}()
+	waitInFlight(t)
+
+	start := time.Now()
+	stop(srv)
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("stop took %s to cancel the probe", elapsed)
+	}
+	select {
+	case b := <-body:
+		if !strings.Contains(b, "iperf3_success{protocol=\"tcp\"} 0") {
+			t.Errorf("cancelled probe didn't report its failure:\n%s", b)
+		}
+	case <-time.After(time.Second):
+		t.Error("cancelled probe didn't return")
+	}
+}
+
+func TestCollectCancelled(t *testing.T) {
+	defer fakeIperf3Script(t, "echo $$ > \"$0.pid\"\n"+slowIperf3)()
+	path, err := exec.LookPath(iperfCmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	config := probeConfig{target: "127.0.0.1", port: 5201, timeout: 30 * time.Second, parallel: 1}
+	cancels := testutil.ToFloat64(iperfCancels)
+	done := make(chan struct{})
+	go func() {
+		ch := make(chan prometheus.Metric, 100)
+		NewExporter(ctx, config, nil).Collect(ch)
+		close(done)
+	}()
+
+	var pid int
+	for deadline := time.Now().Add(5 * time.Second); pid == 0; time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("iperf3 didn't start")
+		}
+		b, _ := ioutil.ReadFile(path + ".pid")
+		pid, _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("Collect didn't return after the request was cancelled")
+	}
+	if p, err := os.FindProcess(pid); err == nil && p.Signal(syscall.Signal(0)) == nil {
+		t.Errorf("iperf3 process %d still running after the request was cancelled", pid)
+	}
+	if got := testutil.ToFloat64(iperfCancels) - cancels; got != 1 {
+		t.Errorf("counted %v cancelled probes, want 1", got)
+	}
+}
+
+// collectFixture probes with iperf3 reporting the JSON fixture from testdata,
+// and returns the metrics of the successful probe as collectProbe does.
+func collectFixture(t *testing.T, config probeConfig, fixture string) map[string]float64 {
+	path, err := filepath.Abs(filepath.Join("testdata", fixture))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fakeIperf3Script(t, "cat '"+path+"'\n")()
+
+	metrics := collectProbe(t, config)
+	if metrics["iperf3_success"] != 1 {
+		t.Fatalf("probe reporting %s failed", fixture)
+	}
+	return metrics
+}
+
+// collectProbe probes 127.0.0.1 unless the config has another target, and
+// returns the probe metrics by name and labels, leaving out the protocol
+// label all of them have.
+func collectProbe(t *testing.T, config probeConfig) map[string]float64 {
+	if config.target == "" {
+		config.target = "127.0.0.1"
+	}
+	if config.port == 0 {
+		config.port = 5201
+	}
+	config.timeout, config.parallel = 10*time.Second, 1
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(NewExporter(context.Background(), config, nil))
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := map[string]float64{}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			var labels []string
+			for _, label := range metric.GetLabel() {
+				if label.GetName() != "protocol" {
+					labels = append(labels, label.GetName()+"="+strconv.Quote(label.GetValue()))
+				}
+			}
+			name := family.GetName()
+			if len(labels) > 0 {
+				name += "{" + strings.Join(labels, ",") + "}"
+			}
+			metrics[name] = metric.GetGauge().GetValue()
+		}
+	}
+	return metrics
+}
+
+// checkMetrics reports the metrics missing from got or with other values.
+func checkMetrics(t *testing.T, got, want map[string]float64) {
+	t.Helper()
+	for name, value := range want {
+		if v, ok := got[name]; !ok {
+			t.Errorf("%s missing", name)
+		} else if math.Abs(v-value) > 1e-9*math.Max(1, math.Abs(value)) {
+			t.Errorf("%s = %v, want %v", name, v, value)
+		}
+	}
+}
+
+func TestFixtureMetrics(t *testing.T) {
+	tests := []struct {
+		name    string
+		fixture string
+		config  probeConfig
+		want    map[string]float64
+		absent  []string
+	}{
+		{"tcp", "iperf3_tcp.json", probeConfig{}, map[string]float64{
+			"iperf3_mean_rtt_ms":                   0.5,
+			"iperf3_min_rtt_ms":                    0.3,
+			"iperf3_max_rtt_ms":                    0.6,
+			"iperf3_rttvar_ms":                     0.25,
+			"iperf3_snd_cwnd_bytes":                1.2e6,
+			"iperf3_pmtu_bytes":                    9000,
+			"iperf3_retransmit_rate":               1.0 / 375,
+			"iperf3_bandwidth_delay_product_bytes": 35000,
+			"iperf3_host_cpu_total_percent":        10.5,
+			"iperf3_remote_cpu_total_percent":      4.2,
+			"iperf3_sent_bps_min":                  5.6e8,
+			"iperf3_sent_bps_max":                  6e8,
+			"iperf3_sent_bps_stddev":               2e7,
+		}, nil},
+		{"tcp parallel", "iperf3_tcp_parallel.json", probeConfig{}, map[string]float64{
+			// The mean round-trip time and variation are averaged across
+			// the streams, while the range spans them.
+			"iperf3_mean_rtt_ms": 0.5,
+			"iperf3_min_rtt_ms":  0.2,
+			"iperf3_max_rtt_ms":  1.1,
+			"iperf3_rttvar_ms":   0.2,
+			// The congestion windows of the last interval are summed.
+			"iperf3_snd_cwnd_bytes": 1.4e6,
+			// The path MTU is the first stream's in the last interval.
+			"iperf3_pmtu_bytes":                    1500,
+			"iperf3_retransmit_rate":               0.008,
+			"iperf3_bandwidth_delay_product_bytes": 48125,
+			// The omitted first interval is left out of the statistics.
+			"iperf3_sent_bps_min":             7.8e8,
+			"iperf3_sent_bps_max":             8.2e8,
+			"iperf3_sent_bps_stddev":          16329931.618554521,
+			"iperf3_host_cpu_total_percent":   20.1,
+			"iperf3_remote_cpu_total_percent": 7.5,
+		}, []string{`iperf3_stream_sent_bps{stream="0"}`}},
+		{"tcp per stream", "iperf3_tcp_parallel.json", probeConfig{perStream: true}, map[string]float64{
+			`iperf3_stream_sent_bps{stream="0"}`:     4e8,
+			`iperf3_stream_sent_bps{stream="1"}`:     4e8,
+			`iperf3_stream_received_bps{stream="0"}`: 3.8e8,
+			`iperf3_stream_received_bps{stream="1"}`: 3.9e8,
+			`iperf3_stream_retransmits{stream="0"}`:  3,
+			`iperf3_stream_retransmits{stream="1"}`:  1,
+		}, nil},
+		{"udp", "iperf3_udp.json", probeConfig{udp: true, reverse: true}, map[string]float64{
+			"iperf3_udp_packet_length_bytes":   1448,
+			"iperf3_received_jitter_ms":        0.08,
+			"iperf3_lost_packets":              1,
+			"iperf3_packets":                   273,
+			"iperf3_received_jitter_ms_min":    0.02,
+			"iperf3_received_jitter_ms_max":    0.08,
+			"iperf3_received_jitter_ms_stddev": 0.024494897427831782,
+		}, []string{"iperf3_mean_rtt_ms", "iperf3_retransmits"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := collectFixture(t, test.config, test.fixture)
+			checkMetrics(t, got, test.want)
+			for _, name := range test.absent {
+				if _, ok := got[name]; ok {
+					t.Errorf("%s exported", name)
+				}
+			}
+		})
+	}
+}
+
+func TestJitterStats(t *testing.T) {
+	tests := []struct {
+		output string
+		ok     bool
+	}{
+		// The sending side doesn't report the jitter of its intervals.
+		{`{"intervals":[{"sum":{"bits_per_second":1e6}},{"sum":{"bits_per_second":1e6}}]}`, false},
+		{`{"intervals":[{"sum":{"jitter_ms":0.02}}]}`, false},
+		{`{"intervals":[{"sum":{"jitter_ms":0.5,"omitted":true}},{"sum":{"jitter_ms":0.02}}]}`, false},
+		{`{"intervals":[{"sum":{"jitter_ms":0}},{"sum":{"jitter_ms":0.02}}]}`, true},
+	}
+	for _, test := range tests {
+		var stats iperfResult
+		if err := json.Unmarshal([]byte(test.output), &stats); err != nil {
+			t.Fatal(err)
+		}
+		if _, _, _, ok := stats.jitterStats(); ok != test.ok {
+			t.Errorf("jitterStats() of %s got ok %v, want %v", test.output, ok, test.ok)
+		}
+	}
+}
+
+func TestRoundSigFigs(t *testing.T) {
+	tests := []struct {
+		value float64
+		n     int
+		want  float64
+	}{
+		{123456789, 3, 123000000},
+		{0.0026666, 2, 0.0027},
+		{-987.65, 2, -990},
+		{1000, 1, 1000},
+		{99.96, 3, 100},
+		{0, 3, 0},
+		{123.456, 0, 123.456},
+		{math.Inf(1), 3, math.Inf(1)},
+	}
+	for _, test := range tests {
+		if got := roundSigFigs(test.value, test.n); got != test.want && math.Abs(got-test.want) > 1e-12*math.Max(1, math.Abs(test.want)) {
+			t.Errorf("roundSigFigs(%v, %d) = %v, want %v", test.value, test.n, got, test.want)
+		}
+	}
+	if got := roundSigFigs(math.NaN(), 3); !math.IsNaN(got) {
+		t.Errorf("roundSigFigs(NaN, 3) = %v, want NaN", got)
+	}
+}
+
+func TestRoundedMetrics(t *testing.T) {
+	defer func(n int) { *sigFigs = n }(*sigFigs)
+	*sigFigs = 2
+	checkMetrics(t, collectFixture(t, probeConfig{}, "iperf3_tcp_parallel.json"), map[string]float64{
+		"iperf3_sent_bps_stddev":        1.6e7,
+		"iperf3_received_bytes":         4.8e8,
+		"iperf3_host_cpu_total_percent": 20,
+		"iperf3_pmtu_bytes":             1500,
+	})
+}
+
+func TestServerInfo(t *testing.T) {
+	tests := []struct {
+		output   string
+		version  string
+		serverOS string
+		ok       bool
+	}{
+		{`{}`, "", "", false},
+		{`{"server_output_json":{"start":{"version":""}}}`, "", "", false},
+		{`{"server_output_json":{"start":{"version":"iperf 3.16","system_info":"Linux iperf-server 6.1.0-18-amd64 #1 SMP PREEMPT_DYNAMIC x86_64"}}}`, "iperf 3.16", "Linux", true},
+		{`{"server_output_json":{"start":{"version":"iperf 3.9"}}}`, "iperf 3.9", "", true},
+	}
+	for _, test := range tests {
+		var stats iperfResult
+		if err := json.Unmarshal([]byte(test.output), &stats); err != nil {
+			t.Fatal(err)
+		}
+		version, serverOS, ok := stats.serverInfo()
+		if version != test.version || serverOS != test.serverOS || ok != test.ok {
+			t.Errorf("serverInfo() of %s = %q, %q, %v, want %q, %q, %v", test.output, version, serverOS, ok, test.version, test.serverOS, test.ok)
+		}
+	}
+}
+
+func TestServerOutputMetrics(t *testing.T) {
+	got := collectFixture(t, probeConfig{serverOutput: true}, "iperf3_tcp_server_output.json")
+	checkMetrics(t, got, map[string]float64{
+		`iperf3_server_info{os="Linux",version="iperf 3.16"}`: 1,
+		// The client's report of the server CPU takes precedence.
+		"iperf3_remote_cpu_total_percent": 4.2,
+	})
+	if _, ok := got["iperf3_remote_cpu_utilization_percent"]; ok {
+		t.Error("server CPU utilization exported twice")
+	}
+}
+
+func TestRemoteCPUFallback(t *testing.T) {
+	var stats iperfResult
+	if got := stats.remoteCPU(); got != 0 {
+		t.Errorf("got remote CPU %v without any report, want 0", got)
+	}
+	if err := json.Unmarshal([]byte(`{"server_output_json":{"end":{"cpu_utilization_percent":{"host_total":4.3}}}}`), &stats); err != nil {
+		t.Fatal(err)
+	}
+	if got := stats.remoteCPU(); got != 4.3 {
+		t.Errorf("got remote CPU %v, want the server's own report of 4.3", got)
+	}
+	stats.End.CPUUtilizationPercent.RemoteTotal = 4.2
+	if got := stats.remoteCPU(); got != 4.2 {
+		t.Errorf("got remote CPU %v, want the client's report of 4.2", got)
+	}
+}
+
+func TestProbeState(t *testing.T) {
+	defer func(retransmits, bandwidth, loss float64) {
+		*degradedRetransmits, *degradedBandwidth, *degradedLoss = retransmits, bandwidth, loss
+	}(*degradedRetransmits, *degradedBandwidth, *degradedLoss)
+	*degradedRetransmits, *degradedBandwidth, *degradedLoss = 10, 800, 5
+
+	result := func(retransmits, receivedBytes, reverseBytes, lost, reverseLost float64) iperfResult {
+		var r iperfResult
+		r.End.SumSent.Retransmits = retransmits
+		r.End.SumReceived = receivedSum{Seconds: 1, Bytes: receivedBytes}
+		r.End.SumReceivedBidirReverse = receivedSum{Seconds: 1, Bytes: reverseBytes}
+		r.End.Sum.LostPercent, r.End.SumBidirReverse.LostPercent = lost, reverseLost
+		return r
+	}
+	tcp, bidir, udp := probeConfig{}, probeConfig{bidir: true}, probeConfig{udp: true}
+	tests := []struct {
+		name   string
+		stats  iperfResult
+		config probeConfig
+		want   string
+	}{
+		{"retransmits at the threshold", result(10, 100, 0, 0, 0), tcp, "up"},
+		{"retransmits above the threshold", result(11, 100, 0, 0, 0), tcp, "degraded"},
+		{"bandwidth at the threshold", result(0, 100, 0, 0, 0), tcp, "up"},
+		{"bandwidth below the threshold", result(0, 99, 0, 0, 0), tcp, "degraded"},
+		{"bidir bandwidth received from the server", result(0, 99, 100, 0, 0), bidir, "up"},
+		{"bidir bandwidth below the threshold", result(0, 100, 99, 0, 0), bidir, "degraded"},
+		{"loss at the threshold", result(0, 100, 0, 5, 0), udp, "up"},
+		{"loss above the threshold", result(0, 100, 0, 5.1, 0), udp, "degraded"},
+		{"reverse loss above the threshold", result(0, 100, 0, 0, 5.1), udp, "degraded"},
+		{"loss of a TCP test", result(0, 100, 0, 50, 0), tcp, "up"},
+	}
+	for _, test := range tests {
+		if got := probeState(test.stats, test.config); got != test.want {
+			t.Errorf("%s: got state %s, want %s", test.name, got, test.want)
+		}
+	}
+}
+
+func TestProbeStateDown(t *testing.T) {
+	defer fakeIperf3(t, 1)()
+
+	got := collectProbe(t, probeConfig{})
+	checkMetrics(t, got, map[string]float64{
+		"iperf3_success":             0,
+		`iperf3_state{state="down"}`: 1,
+	})
+}
+
+// dryRun returns the iperf arguments of a dry run of the probe with the query.
+func dryRun(t *testing.T, query string) []string {
+	t.Helper()
+	rec := probeRequest(query + "&dry_run=true")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("dry run of %q got status %d: %s", query, rec.Code, rec.Body.String())
+	}
+	var command struct {
+		Command string
+		Args    []string
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &command); err != nil {
+		t.Fatal(err)
+	}
+	return command.Args
+}
+
+// argValue returns the value following the option in args.
+func argValue(args []string, option string) string {
+	for i, arg := range args[:len(args)-1] {
+		if arg == option {
+			return args[i+1]
+		}
+	}
+	return ""
+}
+
+// hasArg reports whether args has the argument.
+func hasArg(args []string, arg string) bool {
+	for _, a := range args {
+		if a == arg {
+			return true
+		}
+	}
+	return false
+}
+
+// paramTest is a dry run probe request and either the iperf3 option it must
+// have, with the value unless it is empty, or the error it must be rejected
+// with. An option prefixed with '!' must be missing.
+type paramTest struct {
+	query         string
+	scrapeTimeout string
+	option        string
+	value         string
+	err           string
+}
+
+// checkParams runs the dry run probe requests of the tests.
+func checkParams(t *testing.T, tests []paramTest) {
+	t.Helper()
+	for _, test := range tests {
+		req := httptest.NewRequest("GET", "/probe?"+test.query+"&dry_run=true", nil)
+		if test.scrapeTimeout != "" {
+			req.Header.Set("X-Prometheus-Scrape-Timeout-Seconds", test.scrapeTimeout)
+		}
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		if test.err != "" {
+			if rec.Code != http.StatusBadRequest || !strings.Contains(rec.Body.String(), test.err) {
+				t.Errorf("%q got status %d: %s, want 400: %s", test.query, rec.Code, strings.TrimSpace(rec.Body.String()), test.err)
+			}
+			continue
+		}
+		if rec.Code != http.StatusOK {
+			t.Errorf("%q got status %d: %s", test.query, rec.Code, strings.TrimSpace(rec.Body.String()))
+			continue
+		}
+		var command struct{ Args []string }
+		if err := json.Unmarshal(rec.Body.Bytes(), &command); err != nil {
+			t.Fatal(err)
+		}
+		args := command.Args
+		switch {
+		case strings.HasPrefix(test.option, "!"):
+			if hasArg(args, test.option[1:]) {
+				t.Errorf("%q got %q, want no %s", test.query, args, test.option[1:])
+			}
+		case test.value == "":
+			if !hasArg(args, test.option) {
+				t.Errorf("%q got %q, want %s", test.query, args, test.option)
+			}
+		default:
+			if got := argValue(args, test.option); got != test.value {
+				t.Errorf("%q got %s %q, want %q", test.query, test.option, got, test.value)
+			}
+		}
+	}
+}
+
+func TestBindAndTimeoutParameters(t *testing.T) {
+	defer func(r hostResolver) { resolver = r }(resolver)
+	resolver = fakeResolver{"client.example.com": {"192.0.2.1"}}
+	defer func(d, max time.Duration) { *timeout, *maxTimeout = d, max }(*timeout, *maxTimeout)
+	*timeout, *maxTimeout = time.Minute, 2*time.Minute
+
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!-B"},
+		{query: "target=127.0.0.1&bind=192.0.2.1", option: "-B", value: "192.0.2.1"},
+		{query: "target=127.0.0.1&bind=client.example.com", option: "-B", value: "client.example.com"},
+		{query: "target=127.0.0.1&bind=missing.example.com", err: "'bind' parameter must be an IP address or resolvable hostname"},
+		// The configured timeout applies without any lower cap.
+		{query: "target=127.0.0.1&period=45s", option: "-t", value: "45"},
+		{query: "target=127.0.0.1&period=60s", err: "must be shorter than the probe timeout of each run (1m0s)"},
+		{query: "target=127.0.0.1&period=80s", scrapeTimeout: "90", option: "-t", value: "80"},
+	})
+}
+
+func TestWindowParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!-w"},
+		{query: "target=127.0.0.1&window=256K", option: "-w", value: "256K"},
+		{query: "target=127.0.0.1&window=1M", option: "-w", value: "1M"},
+		{query: "target=127.0.0.1&window=65536", option: "-w", value: "65536"},
+		{query: "target=127.0.0.1&window=512X", err: "'window' parameter must be a size such as 256K or 1M"},
+		{query: "target=127.0.0.1&window=-1M", err: "'window' parameter must be a size"},
+	})
+}
+
+func TestMSSParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!-M"},
+		{query: "target=127.0.0.1&mss=1400", option: "-M", value: "1400"},
+		{query: "target=127.0.0.1&mss=88", option: "-M", value: "88"},
+		{query: "target=127.0.0.1&mss=9000", option: "-M", value: "9000"},
+		{query: "target=127.0.0.1&mss=87", err: "'mss' parameter must be between 88 and 9000 bytes, got 87"},
+		{query: "target=127.0.0.1&mss=9001", err: "'mss' parameter must be between 88 and 9000 bytes, got 9001"},
+		{query: "target=127.0.0.1&mss=1.4K", err: "'mss' parameter must be an integer"},
+	})
+}
+
+func TestStrictTimingParameter(t *testing.T) {
+	defer func(d, max time.Duration) { *timeout, *maxTimeout = d, max }(*timeout, *maxTimeout)
+	*timeout, *maxTimeout = 10*time.Second, 0
+	defer currentSettings().restore()
+	*defaultPeriod = 15 * time.Second
+
+	checkParams(t, []paramTest{
+		// The default period is shortened to fit the timeout, unless timing
+		// is strict.
+		{query: "target=127.0.0.1", option: "-t", value: "9"},
+		{query: "target=127.0.0.1&strict_timing=false", option: "-t", value: "9"},
+		{query: "target=127.0.0.1&strict_timing=true", err: "'period' parameter (15s) must be shorter than the probe timeout of each run (10s)"},
+		{query: "target=127.0.0.1&strict_timing=true&period=5s", option: "-t", value: "5"},
+		{query: "target=127.0.0.1&strict_timing=true&period=10s", err: "must be shorter than the probe timeout"},
+		{query: "target=127.0.0.1&strict_timing=yes", err: "'strict_timing' parameter must be a boolean"},
+	})
+}
+
+func TestLengthParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!-l"},
+		{query: "target=127.0.0.1&udp_mode=true&length=1460", option: "-l", value: "1460"},
+		{query: "target=127.0.0.1&length=8K", option: "-l", value: "8K"},
+		{query: "target=127.0.0.1&length=jumbo", err: "'length' parameter must be a size such as 1460 or 8K, got \"jumbo\""},
+		{query: "target=127.0.0.1&length=8KB", err: "'length' parameter must be a size"},
+	})
+}
+
+func TestOmitParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!-O"},
+		{query: "target=127.0.0.1&period=5s&omit=2", option: "-O", value: "2"},
+		{query: "target=127.0.0.1&period=5s&omit=4", option: "-O", value: "4"},
+		{query: "target=127.0.0.1&period=5s&omit=5", err: "'omit' parameter must be less than the test period (5s), got 5"},
+		{query: "target=127.0.0.1&period=5s&omit=6", err: "'omit' parameter must be less than the test period"},
+		// Tests sending bytes have no period to compare with.
+		{query: "target=127.0.0.1&bytes=100M&omit=6", option: "-O", value: "6"},
+		{query: "target=127.0.0.1&omit=-1", err: "'omit' parameter must not be negative"},
+		{query: "target=127.0.0.1&omit=1s", err: "'omit' parameter must be an integer"},
+	})
+}
+
+func TestIPVersionParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!-4"},
+		{query: "target=127.0.0.1", option: "!-6"},
+		{query: "target=127.0.0.1&ip_version=4", option: "-4"},
+		{query: "target=127.0.0.1&ip_version=6", option: "-6"},
+		{query: "target=127.0.0.1&ip_version=5", err: "'ip_version' parameter must be 4 or 6, got \"5\""},
+		{query: "target=127.0.0.1&ip_version=ipv6", err: "'ip_version' parameter must be 4 or 6"},
+	})
+}
+
+func TestUDPModeParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!-u"},
+		{query: "target=127.0.0.1&udp_mode=true", option: "-u"},
+		{query: "target=127.0.0.1&udp_mode=1", option: "-u"},
+		{query: "target=127.0.0.1&udp_mode=false", option: "!-u"},
+		{query: "target=127.0.0.1&udp_mode=udp", err: "'udp_mode' parameter must be a boolean"},
+	})
+}
+
+func TestSCTPParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!--sctp"},
+		{query: "target=127.0.0.1&sctp=true", option: "--sctp"},
+		{query: "target=127.0.0.1&sctp=true", option: "!-u"},
+		{query: "target=127.0.0.1&sctp=false", option: "!--sctp"},
+		{query: "target=127.0.0.1&sctp=maybe", err: "'sctp' parameter must be a boolean"},
+		{query: "target=127.0.0.1&sctp=true&udp_mode=true", err: "'udp_mode' and 'sctp' parameters are mutually exclusive"},
+	})
+}
+
+func TestBytesParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1&bytes=100M", option: "-n", value: "100M"},
+		{query: "target=127.0.0.1&bytes=100M", option: "!-t"},
+		{query: "target=127.0.0.1&bytes=1G", option: "-n", value: "1G"},
+		{query: "target=127.0.0.1&bytes=lots", err: "'bytes' parameter must be a size such as 100M or 1G, got \"lots\""},
+		{query: "target=127.0.0.1&bytes=100M&period=5s", err: "Only one of the 'period', 'bytes' and 'blockcount' parameters may be specified, got 'period' and 'bytes'"},
+	})
+}
+
+func TestBlockCountParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1&blockcount=1000", option: "-k", value: "1000"},
+		{query: "target=127.0.0.1&blockcount=1000", option: "!-t"},
+		{query: "target=127.0.0.1&blockcount=0", err: "'blockcount' parameter must be positive, got 0"},
+		{query: "target=127.0.0.1&blockcount=1K", err: "'blockcount' parameter must be an integer"},
+		{query: "target=127.0.0.1&blockcount=1000&period=5s", err: "got 'period' and 'blockcount'"},
+		{query: "target=127.0.0.1&blockcount=1000&bytes=100M", err: "got 'bytes' and 'blockcount'"},
+		{query: "target=127.0.0.1&blockcount=1000&bytes=100M&period=5s", err: "got 'period' and 'bytes' and 'blockcount'"},
+	})
+}
+
+func TestBidirParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!--bidir"},
+		{query: "target=127.0.0.1&bidir=true", option: "--bidir"},
+		{query: "target=127.0.0.1&bidir=true&udp_mode=true&bitrate=10M", option: "--bidir"},
+		{query: "target=127.0.0.1&bidir=false", option: "!--bidir"},
+		{query: "target=127.0.0.1&bidir=both", err: "'bidir' parameter must be a boolean"},
+	})
+}
+
+func TestScrapeTimeoutLimits(t *testing.T) {
+	defer func(d, max time.Duration) { *timeout, *maxTimeout = d, max }(*timeout, *maxTimeout)
+	*timeout, *maxTimeout = 30*time.Second, 0
+
+	checkParams(t, []paramTest{
+		// Below the floor, the timeout is raised to 2s and the default
+		// period shortened to fit.
+		{query: "target=127.0.0.1", scrapeTimeout: "0.5", option: "-t", value: "1"},
+		{query: "target=127.0.0.1&period=2s", scrapeTimeout: "0.5", err: "must be shorter than the probe timeout of each run (2s)"},
+		{query: "target=127.0.0.1", scrapeTimeout: "10", option: "-t", value: "5"},
+		{query: "target=127.0.0.1&period=9s", scrapeTimeout: "10", option: "-t", value: "9"},
+		{query: "target=127.0.0.1&period=10s", scrapeTimeout: "10", err: "must be shorter than the probe timeout of each run (10s)"},
+		// Above the maximum, the timeout is lowered to the configured one.
+		{query: "target=127.0.0.1&period=29s", scrapeTimeout: "120", option: "-t", value: "29"},
+		{query: "target=127.0.0.1&period=40s", scrapeTimeout: "120", err: "must be shorter than the probe timeout of each run (30s)"},
+	})
+}
+
+func TestPeriodParameter(t *testing.T) {
+	defer func(d, max time.Duration) { *timeout, *maxTimeout = d, max }(*timeout, *maxTimeout)
+	*timeout, *maxTimeout = 10*time.Second, 0
+	defer currentSettings().restore()
+	*defaultPeriod = 15 * time.Second
+
+	checkParams(t, []paramTest{
+		// Only the default period is shortened to fit the timeout.
+		{query: "target=127.0.0.1", option: "-t", value: "9"},
+		{query: "target=127.0.0.1&period=0s", option: "-t", value: "9"},
+		{query: "target=127.0.0.1&period=0s&bytes=10M", option: "-n", value: "10M"},
+		{query: "target=127.0.0.1&period=15s", err: "'period' parameter (15s) must be shorter than the probe timeout of each run (10s)"},
+		{query: "target=127.0.0.1&period=8s", option: "-t", value: "8"},
+		{query: "target=127.0.0.1&period=-1s", err: "'period' parameter must not be negative, got -1s"},
+		{query: "target=127.0.0.1&period=5", err: "'period' parameter must be a duration"},
+	})
+}
+
+func TestProbeParametersReachIperf3(t *testing.T) {
+	query := "target=127.0.0.1&udp_mode=true&bitrate=50M&bind=127.0.0.2&reverse=true"
+	checkParams(t, []paramTest{
+		{query: query, option: "-u"},
+		{query: query, option: "-b", value: "50M"},
+		{query: query, option: "-B", value: "127.0.0.2"},
+		{query: query, option: "-R"},
+		{query: "target=127.0.0.1&reverse=false", option: "!-R"},
+		{query: "target=127.0.0.1&reverse=on", err: "'reverse' parameter must be a boolean"},
+		{query: "target=127.0.0.1&reverse=true&bidir=true", err: "'reverse' and 'bidir' parameters are mutually exclusive"},
+	})
+}
+
+func TestProtocolLabel(t *testing.T) {
+	defer fakeIperf3(t, 0)()
+
+	for query, protocol := range map[string]string{
+		"target=127.0.0.1":               "tcp",
+		"target=127.0.0.1&udp_mode=true": "udp",
+		"target=127.0.0.1&sctp=true":     "sctp",
+	} {
+		rec := probeRequest(query)
+		for _, line := range strings.Split(rec.Body.String(), "\n") {
+			if !strings.HasPrefix(line, "iperf3_") {
+				continue
+			}
+			if !strings.Contains(line, `protocol="`+protocol+`"`) {
+				t.Errorf("%q got %s, want protocol %q", query, line, protocol)
+			}
+		}
+		if !strings.Contains(rec.Body.String(), `iperf3_success{protocol="`+protocol+`"} 1`) {
+			t.Errorf("%q got no successful %s probe:\n%s", query, protocol, rec.Body.String())
+		}
+	}
+}
+
+func TestIperfVersion(t *testing.T) {
+	tests := []struct {
+		script  string
+		version string
+	}{
+		{"echo 'iperf 3.16 (cJSON 1.7.15)'\necho 'Linux host 6.1.0 #1 SMP x86_64'\n", "3.16"},
+		{"echo 'iperf 3.9.1 (cJSON 1.7.13)'\n", "3.9.1"},
+		{"echo 'iperf version 2.1.9 (14 March 2023) pthreads' >&2\n", "2.1.9"},
+		{"echo 'iperf'\n", ""},
+		{"echo 'iperf3: error' >&2\nexit 1\n", ""},
+	}
+	for _, test := range tests {
+		restore := fakeIperf3Script(t, test.script)
+		v, err := iperfVersion(context.Background())
+		restore()
+		if v != test.version || (err == nil) != (test.version != "") {
+			t.Errorf("iperfVersion() of %q = %q, %v, want %q", test.script, v, err, test.version)
+		}
+	}
+}
+
+// durationCount returns the number of probe durations observed for the target
+// and protocol.
+func durationCount(t *testing.T, target, protocol string) uint64 {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(iperfDuration)
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, family := range families {
+		for _, metric := range family.GetMetric() {
+			labels := map[string]string{}
+			for _, label := range metric.GetLabel() {
+				labels[label.GetName()] = label.GetValue()
+			}
+			if labels["target"] == target && labels["protocol"] == protocol {
+				return metric.GetHistogram().GetSampleCount()
+			}
+		}
+	}
+	return 0
+}
+
+func TestDurationHistogram(t *testing.T) {
+	defer fakeIperf3(t, 0)()
+
+	tcp, udp := durationCount(t, "127.0.0.3", "tcp"), durationCount(t, "127.0.0.3", "udp")
+	probeRequest("target=127.0.0.3")
+	probeRequest("target=127.0.0.3")
+	probeRequest("target=127.0.0.3&udp_mode=true")
+	if got := durationCount(t, "127.0.0.3", "tcp") - tcp; got != 2 {
+		t.Errorf("got %d TCP probe durations, want 2", got)
+	}
+	if got := durationCount(t, "127.0.0.3", "udp") - udp; got != 1 {
+		t.Errorf("got %d UDP probe durations, want 1", got)
+	}
+
+	// Rejected requests are not observed.
+	probeRequest("target=127.0.0.3&tos=256")
+	if got := durationCount(t, "127.0.0.3", "tcp") - tcp; got != 2 {
+		t.Errorf("got %d TCP probe durations after a rejected request, want 2", got)
+	}
+}
+
+func TestJSONFormat(t *testing.T) {
+	defer fakeIperf3(t, 0)()
+
+	for _, format := range []string{"", "prometheus"} {
+		rec := probeRequest("target=127.0.0.1&format=" + format)
+		if !strings.HasPrefix(rec.Header().Get("Content-Type"), "text/plain") || !strings.Contains(rec.Body.String(), "iperf3_success") {
+			t.Errorf("format %q got %s:\n%s", format, rec.Header().Get("Content-Type"), rec.Body.String())
+		}
+	}
+
+	rec := probeRequest("target=127.0.0.1&format=json")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got content type %q, want application/json", contentType)
+	}
+	var result struct {
+		End struct {
+			SumSent     struct{ Seconds, Bytes float64 } `json:"sum_sent"`
+			SumReceived struct{ Seconds, Bytes float64 } `json:"sum_received"`
+		} `json:"end"`
+		Duration *float64 `json:"duration_seconds"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &result); err != nil {
+		t.Fatal(err)
+	}
+	if result.End.SumSent.Bytes != 1000 || result.End.SumReceived.Bytes != 900 || result.Duration == nil {
+		t.Errorf("got %s, want the sent and received bytes and the duration", rec.Body.String())
+	}
+
+	if rec := probeRequest("target=127.0.0.1&format=xml"); rec.Code != http.StatusBadRequest {
+		t.Errorf("format xml got status %d, want 400", rec.Code)
+	}
+}
+
+func TestFQRateParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!--fq-rate"},
+		{query: "target=127.0.0.1&fq_rate=500M", option: "--fq-rate", value: "500M"},
+		{query: "target=127.0.0.1&fq_rate=500M&bitrate=1G", option: "--fq-rate", value: "500M"},
+		{query: "target=127.0.0.1&fq_rate=500M&bitrate=1G", option: "-b", value: "1G"},
+		{query: "target=127.0.0.1&fq_rate=fast", err: "'fq_rate' parameter must be a rate such as 100M or 1G, got \"fast\""},
+	})
+}
+
+func TestClientPortParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!--cport"},
+		{query: "target=127.0.0.1&cport=40000", option: "--cport", value: "40000"},
+		{query: "target=127.0.0.1&cport=65535", option: "--cport", value: "65535"},
+		// Each parallel stream uses the next port.
+		{query: "target=127.0.0.1&cport=65532&parallel=4", option: "--cport", value: "65532"},
+		{query: "target=127.0.0.1&cport=65533&parallel=4", err: "'cport' parameter must be between 1 and 65532 with 4 parallel streams, got 65533"},
+		{query: "target=127.0.0.1&cport=0", err: "'cport' parameter must be between 1 and 65535"},
+		{query: "target=127.0.0.1&cport=65536", err: "'cport' parameter must be between 1 and 65535"},
+		{query: "target=127.0.0.1&cport=high", err: "'cport' parameter must be an integer"},
+		{query: "target=127.0.0.1&port=5201,5202&cport=40000", err: "'cport' parameter can't be combined with several ports"},
+	})
+}
+
+func TestZeroCopyParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!-Z"},
+		{query: "target=127.0.0.1&zerocopy=false", option: "!-Z"},
+		{query: "target=127.0.0.1&zerocopy=true", option: "-Z"},
+		{query: "target=127.0.0.1&zerocopy=true&reverse=true&parallel=4", option: "-Z"},
+		{query: "target=127.0.0.1&zerocopy=true&reverse=true&parallel=4", option: "-R"},
+		{query: "target=127.0.0.1&zerocopy=true&reverse=true&parallel=4", option: "-P", value: "4"},
+		{query: "target=127.0.0.1&zerocopy=sendfile", err: "'zerocopy' parameter must be a boolean"},
+	})
+}
+
+// captureLogs writes the logs to a temporary file until the returned function
+// is called, which returns them.
+func captureLogs(t *testing.T) func() string {
+	f, err := ioutil.TempFile("", "iperf3_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stderr := os.Stderr
+	os.Stderr = f
+	if err := log.Base().SetFormat("logger:stderr"); err != nil {
+		t.Fatal(err)
+	}
+	return func() string {
+		os.Stderr = stderr
+		log.Base().SetFormat("logger:stderr")
+		f.Close()
+		defer os.Remove(f.Name())
+		b, err := ioutil.ReadFile(f.Name())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(b)
+	}
+}
+
+func TestRequestID(t *testing.T) {
+	defer fakeIperf3(t, 2)()
+
+	logs := captureLogs(t)
+	first := probeRequest("target=127.0.0.1")
+	second := probeRequest("target=127.0.0.1")
+	out := logs()
+
+	ids := map[string]bool{}
+	for _, rec := range []*httptest.ResponseRecorder{first, second} {
+		id := rec.Header().Get("X-Request-Id")
+		if !regexp.MustCompile(`^[0-9a-f]{16}$`).MatchString(id) {
+			t.Fatalf("got request ID %q, want 16 hex digits", id)
+		}
+		ids[id] = true
+		// The failure logged by the probe carries the ID of its request.
+		if !regexp.MustCompile(`Failed to run iperf against 127.0.0.1.*request_id=` + id).MatchString(out) {
+			t.Errorf("request ID %s not in the probe logs:\n%s", id, out)
+		}
+	}
+	if len(ids) != 2 {
+		t.Errorf("got the same request ID for both requests")
+	}
+}
+
+func TestTitleParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!-T"},
+		{query: "target=127.0.0.1&title=nightly-run.1", option: "-T", value: "nightly-run.1"},
+		{query: "target=127.0.0.1&title=" + url.QueryEscape(`x"} 1`+"\n"+`iperf3_success{a="b`), err: "'title' parameter must be up to 64 letters"},
+		{query: "target=127.0.0.1&title=a%5Cb", err: "'title' parameter must be up to 64"},
+		{query: "target=127.0.0.1&title=a+b", err: "'title' parameter must be up to 64"},
+		{query: "target=127.0.0.1&title=" + strings.Repeat("a", 65), err: "'title' parameter must be up to 64"},
+	})
+
+	defer fakeIperf3(t, 0)()
+	rec := probeRequest("target=127.0.0.1&title=nightly-run.1")
+	if !strings.Contains(rec.Body.String(), `iperf3_success{protocol="tcp",title="nightly-run.1"} 1`) {
+		t.Errorf("title label missing from the metrics:\n%s", rec.Body.String())
+	}
+}
+
+func TestPacingTimerParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!--pacing-timer"},
+		{query: "target=127.0.0.1&udp_mode=true&pacing_timer=1000", option: "--pacing-timer", value: "1000"},
+		{query: "target=127.0.0.1&pacing_timer=0", err: "'pacing_timer' parameter must be positive, got 0"},
+		{query: "target=127.0.0.1&pacing_timer=-5", err: "'pacing_timer' parameter must be positive"},
+		{query: "target=127.0.0.1&pacing_timer=1ms", err: "'pacing_timer' parameter must be an integer"},
+	})
+}
+
+func TestBytesCounters(t *testing.T) {
+	defer fakeIperf3(t, 0)()
+
+	sent := testutil.ToFloat64(sentBytesTotal.WithLabelValues("127.0.0.4", "tcp"))
+	received := testutil.ToFloat64(receivedBytesTotal.WithLabelValues("127.0.0.4", "tcp"))
+	for i := 1; i <= 2; i++ {
+		probeRequest("target=127.0.0.4")
+		if got := testutil.ToFloat64(sentBytesTotal.WithLabelValues("127.0.0.4", "tcp")) - sent; got != float64(i*1000) {
+			t.Errorf("after %d probes got %v bytes sent, want %d", i, got, i*1000)
+		}
+		if got := testutil.ToFloat64(receivedBytesTotal.WithLabelValues("127.0.0.4", "tcp")) - received; got != float64(i*900) {
+			t.Errorf("after %d probes got %v bytes received, want %d", i, got, i*900)
+		}
+	}
+}
+
+func TestLogToFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "iperf3_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	name := filepath.Join(dir, "iperf3_exporter.log")
+	if err := ioutil.WriteFile(name, []byte("previous line\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	stderr, savedClosers := os.Stderr, closers
+	defer func() {
+		os.Stderr, closers = stderr, savedClosers
+		log.Base().SetFormat("logger:stderr")
+	}()
+	if err := logToFile(name, "logger:stderr"); err != nil {
+		t.Fatal(err)
+	}
+	log.Errorf("Logged to the file")
+	for _, c := range closers[len(savedClosers):] {
+		c.Close()
+	}
+
+	b, err := ioutil.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(string(b), "previous line\n") || !strings.Contains(string(b), "Logged to the file") {
+		t.Errorf("got log file:\n%s", b)
+	}
+
+	if err := logToFile(filepath.Join(dir, "missing", "iperf3_exporter.log"), "logger:stderr"); err == nil {
+		t.Error("unwritable log file got no error")
+	}
+}
+
+func TestExitCodeMetric(t *testing.T) {
+	tests := []struct {
+		script string
+		code   float64
+	}{
+		{"echo '{\"error\":\"unable to send control message: Bad file descriptor\"}'\nexit 3\n", 3},
+		{"exit 1\n", 1},
+		// Killed by a signal, as on timeout.
+		{"kill -9 $$\n", 137},
+	}
+	for _, test := range tests {
+		restore := fakeIperf3Script(t, test.script)
+		metrics := collectProbe(t, probeConfig{})
+		restore()
+		checkMetrics(t, metrics, map[string]float64{"iperf3_success": 0, "iperf3_exit_code": test.code})
+	}
+
+	// The exit code is only exported on failure.
+	defer fakeIperf3(t, 0)()
+	if _, ok := collectProbe(t, probeConfig{})["iperf3_exit_code"]; ok {
+		t.Error("iperf3_exit_code exported by a successful probe")
+	}
+
+	dir, err := ioutil.TempDir("", "iperf3_exporter")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(path string) { os.Setenv("PATH", path) }(os.Getenv("PATH"))
+	os.Setenv("PATH", dir)
+	checkMetrics(t, collectProbe(t, probeConfig{}), map[string]float64{"iperf3_exit_code": -1})
+}
+
+func TestBindDevParameter(t *testing.T) {
+	checkParams(t, []paramTest{
+		{query: "target=127.0.0.1", option: "!--bind-dev"},
+		{query: "target=127.0.0.1&bind_dev=eth0", option: "--bind-dev", value: "eth0"},
+		{query: "target=127.0.0.1&bind_dev=bond0.100", option: "--bind-dev", value: "bond0.100"},
+		{query: "target=127.0.0.1&bind_dev=wg-site_a", option: "--bind-dev", value: "wg-site_a"},
+		{query: "target=127.0.0.1&bind_dev=eth0&bind=127.0.0.2", option: "-B", value: "127.0.0.2"},
+		{query: "target=127.0.0.1&bind_dev=" + strings.Repeat("e", 16), err: "'bind_dev' parameter must be a network interface name"},
+		{query: "target=127.0.0.1&bind_dev=eth0%3Brm", err: "'bind_dev' parameter must be a network interface name"},
+		{query: "target=127.0.0.1&bind_dev=..%2Fetc", err: "'bind_dev' parameter must be a network interface name"},
+	})
+}
+
+func TestCancellationCauses(t *testing.T) {
+	defer fakeIperf3Script(t, slowIperf3)()
+	config := probeConfig{target: "127.0.0.1", port: 5201, period: time.Second, timeout: 200 * time.Millisecond, parallel: 1}
+
+	// The probe timeout is not a cancellation.
+	cancels, timeouts := testutil.ToFloat64(iperfCancels), testutil.ToFloat64(iperfErrors.WithLabelValues("timeout"))
+	if _, _, err := NewExporter(context.Background(), config, nil).probe(); err == nil {
+		t.Fatal("probe outlasting its timeout succeeded")
+	}
+	if got := testutil.ToFloat64(iperfCancels) - cancels; got != 0 {
+		t.Errorf("timed out probe counted %v cancellations, want 0", got)
+	}
+	if got := testutil.ToFloat64(iperfErrors.WithLabelValues("timeout")) - timeouts; got != 1 {
+		t.Errorf("timed out probe counted %v timeouts, want 1", got)
+	}
+
+	// The client going away is.
+	config.timeout = 10 * time.Second
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(200*time.Millisecond, cancel)
+	cancels, timeouts = testutil.ToFloat64(iperfCancels), testutil.ToFloat64(iperfErrors.WithLabelValues("timeout"))
+	if _, _, err := NewExporter(ctx, config, nil).probe(); err == nil {
+		t.Fatal("cancelled probe succeeded")
+	}
+	if got := testutil.ToFloat64(iperfCancels) - cancels; got != 1 {
+		t.Errorf("cancelled probe counted %v cancellations, want 1", got)
+	}
+	if got := testutil.ToFloat64(iperfErrors.WithLabelValues("timeout")) - timeouts; got != 0 {
+		t.Errorf("cancelled probe counted %v timeouts, want 0", got)
+	}
+}
+
+func TestTargetHostPort(t *testing.T) {
+	tests := []struct {
+		query string
+		host  string
+		port  string
+	}{
+		{"target=iperf.example.com", "iperf.example.com", "5201"},
+		{"target=iperf.example.com:5202", "iperf.example.com", "5202"},
+		{"target=192.0.2.1:5202", "192.0.2.1", "5202"},
+		{"target=[::1]:5203", "::1", "5203"},
+		{"target=[::1]", "::1", "5201"},
+		{"target=::1", "::1", "5201"},
+		// An explicit port parameter takes precedence.
+		{"target=iperf.example.com:5202&port=5204", "iperf.example.com", "5204"},
+		{"target=[2001:db8::1]:5202&port=5204", "2001:db8::1", "5204"},
+	}
+	for _, test := range tests {
+		args := dryRun(t, test.query)
+		if host, port := argValue(args, "-c"), argValue(args, "-p"); host != test.host || port != test.port {
+			t.Errorf("%s: got host %q and port %s, want %q and %s", test.query, host, port, test.host, test.port)
+		}
+	}
+
+	for _, query := range []string{"target=iperf.example.com:http", "target=iperf.example.com:70000", "target=[::1]:0"} {
+		if code := probeRequest(query).Code; code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestBidirUDPMetrics(t *testing.T) {
+	got := collectFixture(t, probeConfig{udp: true, bidir: true}, "iperf3_udp_bidir.json")
+	checkMetrics(t, got, map[string]float64{
+		"iperf3_sent_seconds": 5,
+		"iperf3_sent_bytes":   655000,
+		// What the exporter received from the server, not what the
+		// server received from the exporter.
+		"iperf3_received_seconds":                        5,
+		"iperf3_received_bytes":                          640000,
+		`iperf3_received_jitter_ms{direction="forward"}`: 0.02,
+		`iperf3_received_jitter_ms{direction="reverse"}`: 0.05,
+		`iperf3_lost_packets{direction="forward"}`:       3,
+		`iperf3_lost_packets{direction="reverse"}`:       10,
+		`iperf3_packets{direction="forward"}`:            452,
+		`iperf3_packets{direction="reverse"}`:            452,
+		`iperf3_lost_percent{direction="forward"}`:       0.66,
+		`iperf3_lost_percent{direction="reverse"}`:       2.2,
+	})
+	if _, ok := got["iperf3_lost_percent"]; ok {
+		t.Error("bidirectional loss exported without a direction")
+	}
+}
+
+func TestBothDirections(t *testing.T) {
+	fixture, err := filepath.Abs(filepath.Join("testdata", "iperf3_tcp.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fakeIperf3Script(t, "echo \"$@\" >> \"$0.args\"\ncat '"+fixture+"'\n")()
+	path, err := exec.LookPath(iperfCmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := probeRequest("target=127.0.0.1&direction=both")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	for _, direction := range []string{"forward", "reverse"} {
+		if want := `iperf3_success{direction="` + direction + `",protocol="tcp"} 1`; !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("%s missing from:\n%s", want, rec.Body.String())
+		}
+	}
+
+	// The directions run one after the other, the reverse one last.
+	out, err := ioutil.ReadFile(path + ".args")
+	if err != nil {
+		t.Fatal(err)
+	}
+	runs := strings.Split(strings.TrimSpace(string(out)), "\n")
+	if len(runs) != 2 || hasArg(strings.Fields(runs[0]), "-R") || !hasArg(strings.Fields(runs[1]), "-R") {
+		t.Errorf("got runs %q, want a forward and then a reverse run", runs)
+	}
+
+	for _, query := range []string{
+		"target=127.0.0.1&direction=both&bidir=true",
+		"target=127.0.0.1&direction=both&reverse=true",
+		"target=127.0.0.1&direction=both&format=json",
+		"target=127.0.0.1&direction=both&dry_run=true",
+		"target=127.0.0.1&direction=sideways",
+	} {
+		if code := probeRequest(query).Code; code != http.StatusBadRequest {
+			t.Errorf("%s: got status %d, want %d", query, code, http.StatusBadRequest)
+		}
+	}
+}
+
+func TestRoutePrefix(t *testing.T) {
+	defer fakeIperf3(t, 0)()
+	defer func(saved string) { *routePrefix = saved }(*routePrefix)
+
+	for flag, prefix := range map[string]string{"/": "", "/iperf3": "/iperf3", "iperf3/": "/iperf3", "/a/b/": "/a/b"} {
+		*routePrefix = flag
+		srv := httptest.NewServer(newMux())
+		client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+		get := func(path string) *http.Response {
+			resp, err := client.Get(srv.URL + path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ioutil.ReadAll(resp.Body)
+			resp.Body.Close()
+			return resp
+		}
+
+		for _, path := range []string{"/metrics", "/probe?target=127.0.0.1&dry_run=true", "/health", "/ready", "/"} {
+			if resp := get(prefix + path); resp.StatusCode != http.StatusOK {
+				t.Errorf("--web.route-prefix=%s: %s%s got status %d", flag, prefix, path, resp.StatusCode)
+			}
+		}
+		if prefix != "" {
+			if resp := get(prefix); resp.StatusCode != http.StatusFound || resp.Header.Get("Location") != prefix+"/" {
+				t.Errorf("--web.route-prefix=%s: %s got status %d redirecting to %q", flag, prefix, resp.StatusCode, resp.Header.Get("Location"))
+			}
+			if resp := get("/metrics"); resp.StatusCode != http.StatusNotFound {
+				t.Errorf("--web.route-prefix=%s: /metrics got status %d outside the prefix", flag, resp.StatusCode)
+			}
+		}
+		if resp := get("/debug/pprof/"); resp.StatusCode != http.StatusOK {
+			t.Errorf("--web.route-prefix=%s: /debug/pprof/ got status %d", flag, resp.StatusCode)
+		}
+		srv.Close()
+	}
+}
+
+func TestRateLimitBurst(t *testing.T) {
+	defer func(saved float64) { *rateLimit = saved }(*rateLimit)
+
+	for limit, want := range map[float64]struct {
+		burst      int
+		retryAfter string
+	}{
+		2:   {2, "1"},
+		0.5: {1, "2"},
+	} {
+		*rateLimit = limit
+		mux := newMux()
+		for i := 0; i <= want.burst; i++ {
+			rec := httptest.NewRecorder()
+			mux.ServeHTTP(rec, httptest.NewRequest("GET", "/probe?target=127.0.0.1&dry_run=true", nil))
+			if i < want.burst {
+				if rec.Code != http.StatusOK {
+					t.Errorf("rate %v: request %d within the burst got status %d", limit, i+1, rec.Code)
+				}
+				continue
+			}
+			if rec.Code != http.StatusTooManyRequests {
+				t.Errorf("rate %v: request past the burst of %d got status %d, want %d", limit, want.burst, rec.Code, http.StatusTooManyRequests)
+			}
+			if retry := rec.Header().Get("Retry-After"); retry != want.retryAfter {
+				t.Errorf("rate %v: got Retry-After %q, want %q", limit, retry, want.retryAfter)
+			}
+		}
+	}
+}
+
+func TestDryRun(t *testing.T) {
+	defer fakeIperf3Script(t, "touch \"$0.ran\"\necho '"+fakeResult+"'\n")()
+	path, err := exec.LookPath(iperfCmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rec := probeRequest("target=iperf.example.com:5202&period=5s&udp_mode=true&bitrate=10M&dry_run=true")
+	if rec.Code != http.StatusOK {
+		t.Fatalf("got status %d: %s", rec.Code, rec.Body.String())
+	}
+	if contentType := rec.Header().Get("Content-Type"); contentType != "application/json" {
+		t.Errorf("got content type %q, want application/json", contentType)
+	}
+	want := `{"command":"iperf3","args":["-J","-i","1","-c","iperf.example.com","-p","5202","-P","1","-t","5","-u","-b","10M"]}` + "\n"
+	if rec.Body.String() != want {
+		t.Errorf("got %s, want %s", rec.Body.String(), want)
+	}
+	if _, err := os.Stat(path + ".ran"); err == nil {
+		t.Error("dry run ran iperf3")
+	}
+}
+
+func TestParseBitrate(t *testing.T) {
+	tests := []struct {
+		bitrate string
+		want    float64
+		ok      bool
+	}{
+		{"100M", 1e8, true},
+		{"1G", 1e9, true},
+		{"10K/100", 1e4, true},
+		{"1.5m", 1.5e6, true},
+		{"500", 500, true},
+		{"", 0, false},
+		{"fast", 0, false},
+		{"100X", 0, false},
+		{"-1M", 0, false},
+		{"1G/", 0, false},
+	}
+	for _, test := range tests {
+		got, ok := parseBitrate(test.bitrate)
+		if ok != test.ok || got != test.want {
+			t.Errorf("parseBitrate(%q) = %v, %v, want %v, %v", test.bitrate, got, ok, test.want, test.ok)
+		}
+		if test.bitrate == "" {
+			continue
+		}
+		rec := probeRequest("target=127.0.0.1&udp_mode=true&dry_run=true&bitrate=" + url.QueryEscape(test.bitrate))
+		if test.ok && rec.Code != http.StatusOK || !test.ok && rec.Code != http.StatusBadRequest {
+			t.Errorf("bitrate %q got status %d: %s", test.bitrate, rec.Code, rec.Body.String())
+		}
+	}
+}
+
+func TestTypeOfService(t *testing.T) {
+	tests := []struct {
+		tos    string
+		want   string
+		status int
+	}{
+		{"32", "32", http.StatusOK},
+		{"0x20", "32", http.StatusOK},
+		{"0xff", "255", http.StatusOK},
+		{"0", "", http.StatusOK},
+		{"256", "", http.StatusBadRequest},
+		{"-1", "", http.StatusBadRequest},
+		{"0x100", "", http.StatusBadRequest},
+		{"af41", "", http.StatusBadRequest},
+	}
+	for _, test := range tests {
+		query := "target=127.0.0.1&tos=" + url.QueryEscape(test.tos)
+		if test.status != http.StatusOK {
+			if rec := probeRequest(query + "&dry_run=true"); rec.Code != test.status {
+				t.Errorf("tos %q got status %d, want %d", test.tos, rec.Code, test.status)
+			}
+			continue
+		}
+		if got := argValue(dryRun(t, query), "-S"); got != test.want {
+			t.Errorf("tos %q got -S %q, want %q", test.tos, got, test.want)
+		}
+	}
+}
+
+func TestErrorLogLimiter(t *testing.T) {
+	defer func(interval time.Duration) { *errorInterval = interval }(*errorInterval)
+	*errorInterval = 100 * time.Millisecond
+
+	var out bytes.Buffer
+	logger := log.NewLogger(&out)
+	limiter := &errorLogLimiter{last: map[string]time.Time{}, suppressed: map[string]int{}}
+	for i := 0; i < 3; i++ {
+		limiter.Errorf(logger, "a", "iperf3", "probe of a failed")
+	}
+	limiter.Errorf(logger, "a", "timeout", "probe of a timed out")
+	limiter.Errorf(logger, "b", "iperf3", "probe of b failed")
+	if got := strings.Count(out.String(), "\n"); got != 3 {
+		t.Fatalf("got %d log lines within the interval, want 3:\n%s", got, out.String())
+	}
+
+	time.Sleep(*errorInterval)
+	out.Reset()
+	limiter.Errorf(logger, "a", "iperf3", "probe of a failed")
+	if !strings.Contains(out.String(), "probe of a failed (2 similar errors suppressed)") {
+		t.Errorf("got %q, want the suppressed error count", out.String())
+	}
+	if _, ok := limiter.last["b/iperf3"]; ok {
+		t.Error("target b that stopped failing was not forgotten")
+	}
+
+	*errorInterval = 0
+	out.Reset()
+	for i := 0; i < 3; i++ {
+		limiter.Errorf(logger, "a", "iperf3", "probe of a failed")
+	}
+	if got := strings.Count(out.String(), "\n"); got != 3 {
+		t.Errorf("got %d log lines without an interval, want 3", got)
+	}
+}
+
+// fakeResolver resolves the host names it has addresses for.
+type fakeResolver map[string][]string
+
+func (r fakeResolver) LookupHost(ctx context.Context, host string) ([]string, error) {
+	if addrs, ok := r[host]; ok {
+		return addrs, nil
+	}
+	return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+}
+
+func TestDNSLookupMetrics(t *testing.T) {
+	defer func(r hostResolver) { resolver = r }(resolver)
+	resolver = fakeResolver{"iperf.example.com": {"127.0.0.1"}}
+	defer fakeIperf3Script(t, "echo \"$@\" >> \"$0.args\"\necho '"+fakeResult+"'\n")()
+	path, err := exec.LookPath(iperfCmd)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	metrics := collectProbe(t, probeConfig{target: "iperf.example.com"})
+	checkMetrics(t, metrics, map[string]float64{"iperf3_dns_resolved": 1, "iperf3_success": 1})
+	if _, ok := metrics["iperf3_dns_lookup_seconds"]; !ok {
+		t.Error("iperf3_dns_lookup_seconds missing")
+	}
+
+	metrics = collectProbe(t, probeConfig{target: "missing.example.com"})
+	checkMetrics(t, metrics, map[string]float64{"iperf3_dns_resolved": 0, "iperf3_success": 0, `iperf3_state{state="down"}`: 1})
+	if _, ok := metrics["iperf3_dns_lookup_seconds"]; !ok {
+		t.Error("iperf3_dns_lookup_seconds missing")
+	}
+	if args, err := ioutil.ReadFile(path + ".args"); err != nil || strings.Count(string(args), "\n") != 1 {
+		t.Errorf("got iperf3 runs %q, want only the resolved target", args)
+	}
+
+	// Addresses are not looked up.
+	metrics = collectProbe(t, probeConfig{target: "127.0.0.1"})
+	if _, ok := metrics["iperf3_dns_resolved"]; ok {
+		t.Error("iperf3_dns_resolved reported for an address")
+	}
+}
+
+func TestInFlightGauge(t *testing.T) {
+	defer fakeIperf3(t, 1)()
+	defer func(n int) { *retries = n }(*retries)
+	*retries = 0
+
+	// The first probe fails, the second succeeds and the third is rejected.
+	for i, want := range []string{"iperf3_success{protocol=\"tcp\"} 0", "iperf3_success{protocol=\"tcp\"} 1", "'tos' parameter"} {
+		query := "target=127.0.0.1"
+		if i == 2 {
+			query += "&tos=256"
+		}
+		if rec := probeRequest(query); !strings.Contains(rec.Body.String(), want) {
+			t.Fatalf("probe %q got %s, want %s", query, rec.Body.String(), want)
+		}
+		if got := testutil.ToFloat64(iperfInFlight); got != 0 {
+			t.Errorf("probe %q left %v probes in flight", query, got)
+		}
+	}
+
+	defer fakeIperf3Script(t, slowIperf3)()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		rec := httptest.NewRecorder()
+		handler(rec, httptest.NewRequest("GET", "/probe?target=127.0.0.1", nil).WithContext(ctx))
+	}()
+	waitInFlight(t)
+	if got := testutil.ToFloat64(iperfInFlight); got != 1 {
+		t.Errorf("got %v probes in flight, want 1", got)
+	}
+	cancel()
+	<-done
+	if got := testutil.ToFloat64(iperfInFlight); got != 0 {
+		t.Errorf("cancelled probe left %v probes in flight", got)
+	}
+}
@@ -16,4 +16,7 @@
 
 package main
 
-const iperfCmd = "iperf3"
+const (
+	iperfCmd  = "iperf3"
+	iperf2Cmd = "iperf"
+)
@@ -16,4 +16,7 @@
 
 package main
 
-const iperfCmd = "iperf3.exe"
+const (
+	iperfCmd  = "iperf3.exe"
+	iperf2Cmd = "iperf.exe"
+)
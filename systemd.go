@@ -0,0 +1,53 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+)
+
+// listenFDsStart is the first file descriptor passed by systemd socket
+// activation, see sd_listen_fds(3).
+const listenFDsStart = 3
+
+// systemdListener returns the first listening socket passed by systemd socket
+// activation.
+func systemdListener() (net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, errors.New("no socket passed by systemd, is the exporter started by a socket unit?")
+	}
+	fds, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || fds < 1 {
+		return nil, errors.New("no socket passed by systemd, is the exporter started by a socket unit?")
+	}
+
+	// Don't pass the sockets on to child processes.
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	f := os.NewFile(uintptr(listenFDsStart), "LISTEN_FD_3")
+	defer f.Close()
+
+	l, err := net.FileListener(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use socket passed by systemd: %s", err)
+	}
+	return l, nil
+}
@@ -0,0 +1,87 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestSystemdListenerNotActivated(t *testing.T) {
+	tests := []struct {
+		pid string
+		fds string
+	}{
+		{"", ""},
+		{strconv.Itoa(os.Getpid() + 1), "1"},
+		{"systemd", "1"},
+		{strconv.Itoa(os.Getpid()), "0"},
+		{strconv.Itoa(os.Getpid()), ""},
+	}
+	defer os.Unsetenv("LISTEN_PID")
+	defer os.Unsetenv("LISTEN_FDS")
+	for _, test := range tests {
+		os.Setenv("LISTEN_PID", test.pid)
+		os.Setenv("LISTEN_FDS", test.fds)
+		if l, err := systemdListener(); err == nil {
+			l.Close()
+			t.Errorf("LISTEN_PID=%q LISTEN_FDS=%q got a listener, want an error", test.pid, test.fds)
+		}
+	}
+}
+
+func TestSystemdListener(t *testing.T) {
+	if os.Getenv("SYSTEMD_LISTENER_CHILD") != "" {
+		// Running as the child started below, with the socket as fd 3.
+		os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+		l, err := systemdListener()
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Println(l.Addr(), os.Getenv("LISTEN_PID") == "", os.Getenv("LISTEN_FDS") == "")
+		os.Exit(0)
+	}
+	if runtime.GOOS == "windows" {
+		t.Skip("socket activation is not supported on Windows")
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	f, err := l.(*net.TCPListener).File()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^TestSystemdListener$")
+	cmd.Env = append(os.Environ(), "SYSTEMD_LISTENER_CHILD=1", "LISTEN_FDS=1")
+	cmd.ExtraFiles = []*os.File{f}
+	out, err := cmd.Output()
+	if err != nil {
+		t.Fatalf("child failed: %s: %s", err, out)
+	}
+	if got, want := strings.TrimSpace(string(out)), l.Addr().String()+" true true"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
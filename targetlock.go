@@ -0,0 +1,88 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// errQueueFull is returned when too many probes already wait for a target.
+var errQueueFull = errors.New("too many probes waiting for the target")
+
+// targetLocks limits the number of concurrent probes of each target, by
+// default to one, since concurrent iperf runs against the same server contend
+// for bandwidth and spoil each other's results.
+type targetLocks struct {
+	mutex sync.Mutex
+	locks map[string]*targetLock
+	// Number of probes of a target running at once.
+	limit int
+	// Number of probes that may wait for a target, 0 means unlimited.
+	queue int
+}
+
+// targetLock is the lock of a single target, counting the probes holding or
+// waiting for it so idle locks can be dropped.
+type targetLock struct {
+	ch   chan struct{}
+	refs int
+}
+
+// newTargetLocks returns an initialized targetLocks letting limit probes of
+// each target run at once, and queue more wait for them.
+func newTargetLocks(limit, queue int) *targetLocks {
+	return &targetLocks{locks: map[string]*targetLock{}, limit: limit, queue: queue}
+}
+
+// acquire waits until fewer than the limit of other probes of the target run,
+// or the context is done. It fails with errQueueFull if the queue of the
+// target is full. The returned function releases the lock.
+func (t *targetLocks) acquire(ctx context.Context, target string) (func(), error) {
+	t.mutex.Lock()
+	l, ok := t.locks[target]
+	if !ok {
+		l = &targetLock{ch: make(chan struct{}, t.limit)}
+		t.locks[target] = l
+	}
+	if t.queue > 0 && l.refs >= t.limit+t.queue {
+		t.mutex.Unlock()
+		return nil, errQueueFull
+	}
+	l.refs++
+	t.mutex.Unlock()
+
+	select {
+	case l.ch <- struct{}{}:
+		return func() {
+			<-l.ch
+			t.unref(target, l)
+		}, nil
+	case <-ctx.Done():
+		t.unref(target, l)
+		return nil, ctx.Err()
+	}
+}
+
+// unref drops a reference to the lock, removing it once unused.
+func (t *targetLocks) unref(target string, l *targetLock) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	l.refs--
+	if l.refs == 0 {
+		delete(t.locks, target)
+	}
+}
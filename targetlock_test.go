@@ -0,0 +1,122 @@
+// Copyright 2019 Edgard Castro
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+// http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestTargetLocksSerialize(t *testing.T) {
+	locks := newTargetLocks(1, 0)
+	release, err := locks.acquire(context.Background(), "iperf.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	acquired := make(chan func())
+	go func() {
+		release, err := locks.acquire(context.Background(), "iperf.example.com")
+		if err != nil {
+			t.Error(err)
+		}
+		acquired <- release
+	}()
+
+	// Other targets aren't held up.
+	other, err := locks.acquire(context.Background(), "other.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other()
+
+	select {
+	case <-acquired:
+		t.Fatal("second probe of the target ran concurrently")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	release()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("second probe of the target didn't run after the first")
+	}
+
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left after all probes finished", len(locks.locks))
+	}
+}
+
+func TestTargetLocksLimit(t *testing.T) {
+	locks := newTargetLocks(2, 0)
+	for i := 0; i < 2; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+		defer cancel()
+		release, err := locks.acquire(ctx, "iperf.example.com")
+		if err != nil {
+			t.Fatalf("probe %d: %s", i+1, err)
+		}
+		defer release()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := locks.acquire(ctx, "iperf.example.com"); err != context.DeadlineExceeded {
+		t.Errorf("probe past the limit got %v, want %v", err, context.DeadlineExceeded)
+	}
+	if refs := locks.locks["iperf.example.com"].refs; refs != 2 {
+		t.Errorf("lock has %d references after a timed out wait, want 2", refs)
+	}
+}
+
+func TestTargetLocksQueueFull(t *testing.T) {
+	locks := newTargetLocks(1, 1)
+	release, err := locks.acquire(context.Background(), "iperf.example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	waited := make(chan error)
+	go func() {
+		_, err := locks.acquire(ctx, "iperf.example.com")
+		waited <- err
+	}()
+	// Wait for the second probe to queue.
+	for {
+		locks.mutex.Lock()
+		refs := locks.locks["iperf.example.com"].refs
+		locks.mutex.Unlock()
+		if refs == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	if _, err := locks.acquire(context.Background(), "iperf.example.com"); err != errQueueFull {
+		t.Errorf("probe past the queue got %v, want %v", err, errQueueFull)
+	}
+
+	cancel()
+	if err := <-waited; err != context.Canceled {
+		t.Errorf("cancelled probe got %v, want %v", err, context.Canceled)
+	}
+	release()
+	if len(locks.locks) != 0 {
+		t.Errorf("%d locks left after all probes finished", len(locks.locks))
+	}
+}